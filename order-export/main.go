@@ -0,0 +1,153 @@
+// Command order-export streams orders from the order service and writes them
+// as CSV (one row per line item) or NDJSON (one order per line).
+package main
+
+import (
+    "bufio"
+    "context"
+    "encoding/csv"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "strconv"
+
+    pb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    "google.golang.org/grpc"
+    "google.golang.org/protobuf/encoding/protojson"
+)
+
+var csvHeader = []string{
+    "order_id", "user_id", "status", "created_at", "region",
+    "subtotal_amount", "total_amount",
+    "product_id", "quantity", "price",
+}
+
+func main() {
+    addr := flag.String("addr", os.Getenv("ORDER_SERVICE_ADDR"), "order service address")
+    format := flag.String("format", "csv", "output format: csv or ndjson")
+    out := flag.String("out", "", "output file (default stdout)")
+    userID := flag.String("user", "", "only export orders of this user")
+    orderStatus := flag.String("status", "", "only export orders in this status")
+    createdAfter := flag.String("created-after", "", "RFC 3339 lower bound on created_at")
+    createdBefore := flag.String("created-before", "", "RFC 3339 upper bound on created_at")
+    flag.Parse()
+
+    var write func(io.Writer, pb.OrderService_ExportOrdersClient) (int, error)
+    switch *format {
+    case "csv":
+        write = writeCSV
+    case "ndjson":
+        write = writeNDJSON
+    default:
+        log.Fatalf("unknown format %q", *format)
+    }
+
+    conn, err := grpc.Dial(*addr, grpc.WithInsecure())
+    if err != nil {
+        log.Fatalf("failed to connect to order service: %v", err)
+    }
+    defer conn.Close()
+
+    stream, err := pb.NewOrderServiceClient(conn).ExportOrders(context.Background(), &pb.ExportOrdersRequest{
+        UserId:        *userID,
+        Status:        *orderStatus,
+        CreatedAfter:  *createdAfter,
+        CreatedBefore: *createdBefore,
+    })
+    if err != nil {
+        log.Fatalf("failed to start export: %v", err)
+    }
+
+    var dst io.Writer = os.Stdout
+    if *out != "" {
+        f, err := os.Create(*out)
+        if err != nil {
+            log.Fatalf("failed to create %s: %v", *out, err)
+        }
+        defer f.Close()
+        dst = f
+    }
+
+    buffered := bufio.NewWriter(dst)
+    n, err := write(buffered, stream)
+    if flushErr := buffered.Flush(); err == nil {
+        err = flushErr
+    }
+    if err != nil {
+        log.Fatalf("export failed after %d orders: %v", n, err)
+    }
+
+    log.Printf("exported %d orders", n)
+}
+
+// writeCSV flattens each order into one row per line item, repeating the
+// order columns. Orders without items still get one row.
+func writeCSV(w io.Writer, stream pb.OrderService_ExportOrdersClient) (int, error) {
+    cw := csv.NewWriter(w)
+    if err := cw.Write(csvHeader); err != nil {
+        return 0, err
+    }
+
+    n := 0
+    for {
+        order, err := stream.Recv()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return n, err
+        }
+
+        base := []string{
+            order.Id, order.UserId, order.Status, order.CreatedAt, order.Region,
+            formatAmount(order.SubtotalAmount), formatAmount(order.TotalAmount),
+        }
+        if len(order.Items) == 0 {
+            if err := cw.Write(append(base, "", "", "")); err != nil {
+                return n, err
+            }
+        }
+        for _, item := range order.Items {
+            row := append(base[:len(base):len(base)],
+                item.ProductId, strconv.Itoa(int(item.Quantity)), formatAmount(item.Price))
+            if err := cw.Write(row); err != nil {
+                return n, err
+            }
+        }
+        n++
+    }
+
+    cw.Flush()
+    return n, cw.Error()
+}
+
+// writeNDJSON writes each order, with its items nested, as one JSON line.
+func writeNDJSON(w io.Writer, stream pb.OrderService_ExportOrdersClient) (int, error) {
+    marshal := protojson.MarshalOptions{UseProtoNames: true}
+
+    n := 0
+    for {
+        order, err := stream.Recv()
+        if err == io.EOF {
+            return n, nil
+        }
+        if err != nil {
+            return n, err
+        }
+
+        line, err := marshal.Marshal(order)
+        if err != nil {
+            return n, err
+        }
+        if _, err := fmt.Fprintf(w, "%s\n", line); err != nil {
+            return n, err
+        }
+        n++
+    }
+}
+
+func formatAmount(amount float32) string {
+    return strconv.FormatFloat(float64(amount), 'f', 2, 32)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "strings"
+    "time"
+
+    pb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
+)
+
+// couponState is a stored coupon together with its per-user redemptions.
+type couponState struct {
+    coupon     *pb.Coupon
+    usesByUser map[string]int32
+}
+
+func (s *orderService) CreateCoupon(ctx context.Context, req *pb.CreateCouponRequest) (*pb.CouponResponse, error) {
+    if req.Coupon == nil {
+        return nil, status.Errorf(codes.InvalidArgument, "coupon is required")
+    }
+
+    coupon := proto.Clone(req.Coupon).(*pb.Coupon)
+    coupon.Code = normalizeCouponCode(coupon.Code)
+    coupon.TimesUsed = 0
+    coupon.Disabled = false
+    coupon.CreatedAt = time.Now().Format(time.RFC3339)
+
+    if err := validateCoupon(coupon); err != nil {
+        return nil, status.Errorf(codes.InvalidArgument, "invalid coupon: %v", err)
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, exists := s.coupons[coupon.Code]; exists {
+        return nil, status.Errorf(codes.AlreadyExists, "coupon %s already exists", coupon.Code)
+    }
+
+    s.coupons[coupon.Code] = &couponState{
+        coupon:     coupon,
+        usesByUser: make(map[string]int32),
+    }
+
+    return &pb.CouponResponse{Coupon: proto.Clone(coupon).(*pb.Coupon)}, nil
+}
+
+func (s *orderService) DisableCoupon(ctx context.Context, req *pb.DisableCouponRequest) (*pb.CouponResponse, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    state, exists := s.coupons[normalizeCouponCode(req.Code)]
+    if !exists {
+        return nil, status.Errorf(codes.NotFound, "coupon not found")
+    }
+
+    state.coupon.Disabled = true
+
+    return &pb.CouponResponse{Coupon: proto.Clone(state.coupon).(*pb.Coupon)}, nil
+}
+
+func normalizeCouponCode(code string) string {
+    return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func validateCoupon(coupon *pb.Coupon) error {
+    if coupon.Code == "" {
+        return fmt.Errorf("code is required")
+    }
+
+    switch coupon.Type {
+    case pb.CouponType_PERCENTAGE_OFF:
+        if coupon.PercentOff <= 0 || coupon.PercentOff > 100 {
+            return fmt.Errorf("percent_off must be in (0, 100]")
+        }
+    case pb.CouponType_FIXED_AMOUNT:
+        if coupon.AmountOff <= 0 {
+            return fmt.Errorf("amount_off must be positive")
+        }
+    case pb.CouponType_FREE_ITEM:
+        if coupon.FreeProductId == "" || coupon.FreeQuantity <= 0 {
+            return fmt.Errorf("free_product_id and a positive free_quantity are required")
+        }
+    default:
+        return fmt.Errorf("unknown coupon type")
+    }
+
+    if coupon.MinSpend < 0 || coupon.MaxUses < 0 || coupon.MaxUsesPerUser < 0 {
+        return fmt.Errorf("limits must not be negative")
+    }
+
+    if coupon.ExpiresAt != "" {
+        if _, err := time.Parse(time.RFC3339, coupon.ExpiresAt); err != nil {
+            return fmt.Errorf("expires_at must be RFC 3339: %v", err)
+        }
+    }
+
+    return nil
+}
+
+// applyCoupons validates the cart's coupon codes and returns the discount
+// lines they produce. It must be called with s.mu held; nothing is redeemed
+// until redeemCoupons is called for the same codes.
+//
+// For a cart that re-prices an existing order the coupons were already
+// redeemed, so only the minimum spend is re-checked, and a coupon that no
+// longer qualifies is left out instead of failing the edit.
+func (s *orderService) applyCoupons(c *cart, subtotal float32) ([]*pb.DiscountLine, error) {
+    var discounts []*pb.DiscountLine
+    var discounted float32
+    seen := make(map[string]bool)
+
+    for _, raw := range c.couponCodes {
+        code := normalizeCouponCode(raw)
+        if seen[code] {
+            return nil, status.Errorf(codes.InvalidArgument, "coupon %s applied more than once", code)
+        }
+        seen[code] = true
+
+        state, exists := s.coupons[code]
+        if !exists {
+            return nil, status.Errorf(codes.InvalidArgument, "coupon %s not found", code)
+        }
+        if c.redeemed {
+            if subtotal < state.coupon.MinSpend {
+                continue
+            }
+        } else if err := checkCouponUsable(state, c.userID, subtotal, c.now); err != nil {
+            return nil, err
+        }
+
+        amount := couponDiscount(state.coupon, c.items, subtotal)
+        if remaining := subtotal - discounted; amount > remaining {
+            amount = remaining
+        }
+        discounted += amount
+
+        discounts = append(discounts, &pb.DiscountLine{
+            CouponCode:  code,
+            Description: describeCoupon(state.coupon),
+            Amount:      amount,
+        })
+    }
+
+    return discounts, nil
+}
+
+// redeemCoupons records one use of every discount's coupon by userID. It
+// must be called with s.mu held, after applyCoupons succeeded.
+func (s *orderService) redeemCoupons(userID string, discounts []*pb.DiscountLine) {
+    for _, discount := range discounts {
+        state := s.coupons[discount.CouponCode]
+        state.coupon.TimesUsed++
+        state.usesByUser[userID]++
+    }
+}
+
+// releaseCoupons undoes the redemptions of discounts that an edited order no
+// longer qualifies for. It must be called with s.mu held.
+func (s *orderService) releaseCoupons(userID string, before, after []*pb.DiscountLine) {
+    kept := make(map[string]bool, len(after))
+    for _, discount := range after {
+        kept[discount.CouponCode] = true
+    }
+
+    for _, discount := range before {
+        if kept[discount.CouponCode] {
+            continue
+        }
+        state := s.coupons[discount.CouponCode]
+        state.coupon.TimesUsed--
+        state.usesByUser[userID]--
+    }
+}
+
+// couponCodes returns the codes of the coupons redeemed by an order.
+func couponCodes(discounts []*pb.DiscountLine) []string {
+    codes := make([]string, 0, len(discounts))
+    for _, discount := range discounts {
+        codes = append(codes, discount.CouponCode)
+    }
+    return codes
+}
+
+func checkCouponUsable(state *couponState, userID string, subtotal float32, now time.Time) error {
+    coupon := state.coupon
+
+    if coupon.Disabled {
+        return status.Errorf(codes.FailedPrecondition, "coupon %s is disabled", coupon.Code)
+    }
+    if coupon.ExpiresAt != "" {
+        expiresAt, err := time.Parse(time.RFC3339, coupon.ExpiresAt)
+        if err == nil && !now.Before(expiresAt) {
+            return status.Errorf(codes.FailedPrecondition, "coupon %s has expired", coupon.Code)
+        }
+    }
+    if coupon.MaxUses > 0 && coupon.TimesUsed >= coupon.MaxUses {
+        return status.Errorf(codes.FailedPrecondition, "coupon %s has reached its usage limit", coupon.Code)
+    }
+    if coupon.MaxUsesPerUser > 0 && state.usesByUser[userID] >= coupon.MaxUsesPerUser {
+        return status.Errorf(codes.FailedPrecondition, "coupon %s has already been used by this user", coupon.Code)
+    }
+    if subtotal < coupon.MinSpend {
+        return status.Errorf(codes.FailedPrecondition, "coupon %s requires a minimum spend of %.2f", coupon.Code, coupon.MinSpend)
+    }
+
+    return nil
+}
+
+func couponDiscount(coupon *pb.Coupon, items []*pb.OrderItem, subtotal float32) float32 {
+    switch coupon.Type {
+    case pb.CouponType_PERCENTAGE_OFF:
+        return subtotal * coupon.PercentOff / 100
+    case pb.CouponType_FIXED_AMOUNT:
+        return coupon.AmountOff
+    case pb.CouponType_FREE_ITEM:
+        var amount float32
+        free := coupon.FreeQuantity
+        for _, item := range items {
+            if item.ProductId != coupon.FreeProductId || free == 0 {
+                continue
+            }
+            n := item.Quantity
+            if n > free {
+                n = free
+            }
+            amount += item.Price * float32(n)
+            free -= n
+        }
+        return amount
+    default:
+        return 0
+    }
+}
+
+func describeCoupon(coupon *pb.Coupon) string {
+    switch coupon.Type {
+    case pb.CouponType_PERCENTAGE_OFF:
+        return fmt.Sprintf("%g%% off", coupon.PercentOff)
+    case pb.CouponType_FIXED_AMOUNT:
+        return fmt.Sprintf("%.2f off", coupon.AmountOff)
+    case pb.CouponType_FREE_ITEM:
+        return fmt.Sprintf("%d x %s free", coupon.FreeQuantity, coupon.FreeProductId)
+    default:
+        return ""
+    }
+}
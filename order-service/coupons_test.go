@@ -0,0 +1,54 @@
+package main
+
+import (
+    "context"
+    "testing"
+
+    pb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+)
+
+// TestCancelReleasesCoupons cancels orders through UpdateOrder from each
+// status an order can be cancelled in and checks the coupon use is given
+// back, so the user can redeem a single-use coupon again.
+func TestCancelReleasesCoupons(t *testing.T) {
+    for _, from := range []string{"pending", "confirmed"} {
+        t.Run(from, func(t *testing.T) {
+            s := newOrderService(fakeUserClient{}, nil, orderServiceConfig{})
+            ctx := context.Background()
+            _, err := s.CreateCoupon(ctx, &pb.CreateCouponRequest{Coupon: &pb.Coupon{
+                Code:           "ONCE",
+                Type:           pb.CouponType_FIXED_AMOUNT,
+                AmountOff:      5,
+                MaxUsesPerUser: 1,
+            }})
+            if err != nil {
+                t.Fatalf("CreateCoupon: %v", err)
+            }
+
+            create := &pb.CreateOrderRequest{
+                UserId:      "user_1",
+                Items:       []*pb.OrderItem{{ProductId: "p1", Quantity: 1, Price: 20}},
+                CouponCodes: []string{"ONCE"},
+            }
+            created, err := s.CreateOrder(ctx, create)
+            if err != nil {
+                t.Fatalf("CreateOrder: %v", err)
+            }
+            if from != "pending" {
+                if _, err := s.UpdateOrder(ctx, &pb.UpdateOrderRequest{Id: created.Order.Id, Status: from, Actor: "admin"}); err != nil {
+                    t.Fatalf("UpdateOrder to %s: %v", from, err)
+                }
+            }
+            if _, err := s.UpdateOrder(ctx, &pb.UpdateOrderRequest{Id: created.Order.Id, Status: "cancelled", Actor: "user_1"}); err != nil {
+                t.Fatalf("UpdateOrder to cancelled: %v", err)
+            }
+
+            if used := s.coupons["ONCE"].coupon.TimesUsed; used != 0 {
+                t.Errorf("coupon used %d times after the cancellation, want 0", used)
+            }
+            if _, err := s.CreateOrder(ctx, create); err != nil {
+                t.Errorf("redeeming the coupon again: %v", err)
+            }
+        })
+    }
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+    "context"
+    "sync"
+
+    pb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+)
+
+// Publisher delivers order events to consumers outside the order service.
+// Publish must only return nil once the event has been handed off; the
+// outbox relay retries anything that fails.
+type Publisher interface {
+    Publish(ctx context.Context, event *pb.OrderEvent) error
+    Close() error
+}
+
+// eventSubject maps an event to the subject it is published on.
+func eventSubject(event *pb.OrderEvent) string {
+    switch event.Type {
+    case pb.OrderEventType_ORDER_CREATED:
+        return "orders.created"
+    case pb.OrderEventType_ORDER_PAID:
+        return "orders.paid"
+    case pb.OrderEventType_ORDER_CANCELLED:
+        return "orders.cancelled"
+    case pb.OrderEventType_ORDER_ITEMS_CHANGED:
+        return "orders.items_changed"
+    case pb.OrderEventType_ORDER_EXPIRED:
+        return "orders.expired"
+    case pb.OrderEventType_ORDER_SHIPPED:
+        return "orders.shipped"
+    case pb.OrderEventType_ORDER_DELIVERED:
+        return "orders.delivered"
+    case pb.OrderEventType_ORDER_REFUNDED:
+        return "orders.refunded"
+    case pb.OrderEventType_ORDER_CHARGED_BACK:
+        return "orders.charged_back"
+    default:
+        return "orders.status_changed"
+    }
+}
+
+// memoryPublisher fans events out to in-process subscribers.
+type memoryPublisher struct {
+    mu          sync.RWMutex
+    subscribers map[int]func(*pb.OrderEvent)
+    nextID      int
+}
+
+func newMemoryPublisher() *memoryPublisher {
+    return &memoryPublisher{
+        subscribers: make(map[int]func(*pb.OrderEvent)),
+    }
+}
+
+// Subscribe registers handler for every published event and returns a
+// function that removes it again.
+func (p *memoryPublisher) Subscribe(handler func(*pb.OrderEvent)) func() {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    id := p.nextID
+    p.nextID++
+    p.subscribers[id] = handler
+
+    return func() {
+        p.mu.Lock()
+        defer p.mu.Unlock()
+        delete(p.subscribers, id)
+    }
+}
+
+func (p *memoryPublisher) Publish(ctx context.Context, event *pb.OrderEvent) error {
+    p.mu.RLock()
+    defer p.mu.RUnlock()
+
+    for _, handler := range p.subscribers {
+        handler(event)
+    }
+    return nil
+}
+
+func (p *memoryPublisher) Close() error {
+    return nil
+}
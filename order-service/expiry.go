@@ -0,0 +1,75 @@
+package main
+
+import (
+    "context"
+    "log"
+    "time"
+
+    pb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    "google.golang.org/protobuf/proto"
+)
+
+// reservationReleaser frees whatever stock an order was holding. There is no
+// inventory service yet, so the default implementation does nothing.
+type reservationReleaser interface {
+    Release(ctx context.Context, orderID string) error
+}
+
+type noopReservations struct{}
+
+func (noopReservations) Release(ctx context.Context, orderID string) error {
+    return nil
+}
+
+// runExpirySweeper cancels pending orders past their deadline every interval
+// until ctx is cancelled.
+func (s *orderService) runExpirySweeper(ctx context.Context, interval time.Duration, reservations reservationReleaser) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case now := <-ticker.C:
+            for _, orderID := range s.expireOrders(now) {
+                if err := reservations.Release(ctx, orderID); err != nil {
+                    log.Printf("failed to release reservations for expired order %s: %v", orderID, err)
+                }
+            }
+        }
+    }
+}
+
+// expireOrders cancels every pending order whose deadline is before now and
+// returns their IDs. Status changes and events are committed under the same
+// lock request handlers use, so an order paid concurrently is never expired.
+// An order still holding a partial authorization is left alone: the payment
+// service owns the hold and reports its release when it is voided or
+// expires, after which a later sweep cancels the order. Coupons redeemed by
+// an expired order are given back to the user.
+func (s *orderService) expireOrders(now time.Time) []string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    var expired []string
+    for id, stored := range s.orders {
+        if stored.Status != "pending" || stored.ExpiresAt == "" || stored.AmountAuthorized > 0 {
+            continue
+        }
+        deadline, err := time.Parse(time.RFC3339, stored.ExpiresAt)
+        if err != nil || now.Before(deadline) {
+            continue
+        }
+
+        order := proto.Clone(stored).(*pb.Order)
+        transition(order, "cancelled", actorExpirySweeper, "payment deadline passed", now)
+        s.releaseCoupons(order.UserId, order.Discounts, nil)
+        order.Version++
+        s.enqueueEvent(pb.OrderEventType_ORDER_EXPIRED, order)
+        s.orders[id] = order
+        expired = append(expired, id)
+    }
+
+    return expired
+}
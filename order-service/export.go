@@ -0,0 +1,114 @@
+package main
+
+import (
+    "time"
+
+    pb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
+)
+
+// exportBatchSize bounds how many orders ExportOrders copies per lock
+// acquisition, and so how much memory one export holds at a time.
+const exportBatchSize = 200
+
+// defaultListLimit and maxListLimit bound a ListOrders page; ExportOrders
+// is the way to read every order.
+const (
+    defaultListLimit = 20
+    maxListLimit     = 100
+)
+
+// orderFilter is shared by ListOrders and ExportOrders.
+type orderFilter struct {
+    userID        string
+    status        string
+    createdAfter  time.Time
+    createdBefore time.Time
+}
+
+func newOrderFilter(userID, orderStatus, createdAfter, createdBefore string) (orderFilter, error) {
+    filter := orderFilter{userID: userID, status: orderStatus}
+
+    var err error
+    if createdAfter != "" {
+        if filter.createdAfter, err = time.Parse(time.RFC3339, createdAfter); err != nil {
+            return filter, status.Errorf(codes.InvalidArgument, "created_after must be RFC 3339: %v", err)
+        }
+    }
+    if createdBefore != "" {
+        if filter.createdBefore, err = time.Parse(time.RFC3339, createdBefore); err != nil {
+            return filter, status.Errorf(codes.InvalidArgument, "created_before must be RFC 3339: %v", err)
+        }
+    }
+
+    return filter, nil
+}
+
+func (f orderFilter) matches(order *pb.Order) bool {
+    if f.userID != "" && order.UserId != f.userID {
+        return false
+    }
+    if f.status != "" && order.Status != f.status {
+        return false
+    }
+    if f.createdAfter.IsZero() && f.createdBefore.IsZero() {
+        return true
+    }
+
+    createdAt, err := time.Parse(time.RFC3339, order.CreatedAt)
+    if err != nil {
+        return false
+    }
+    if !f.createdAfter.IsZero() && createdAt.Before(f.createdAfter) {
+        return false
+    }
+    if !f.createdBefore.IsZero() && createdAt.After(f.createdBefore) {
+        return false
+    }
+    return true
+}
+
+func (s *orderService) ExportOrders(req *pb.ExportOrdersRequest, stream pb.OrderService_ExportOrdersServer) error {
+    filter, err := newOrderFilter(req.UserId, req.Status, req.CreatedAfter, req.CreatedBefore)
+    if err != nil {
+        return err
+    }
+
+    for cursor := 0; ; {
+        batch, next := s.exportBatch(filter, cursor)
+        for _, order := range batch {
+            if err := stream.Send(order); err != nil {
+                return err
+            }
+        }
+        if next == cursor {
+            return nil
+        }
+        cursor = next
+
+        if err := stream.Context().Err(); err != nil {
+            return status.FromContextError(err).Err()
+        }
+    }
+}
+
+// exportBatch copies up to exportBatchSize matching orders, starting at
+// position cursor in creation order, and returns the position to resume
+// from. The lock is released before anything is sent, so a slow client
+// never blocks writers.
+func (s *orderService) exportBatch(filter orderFilter, cursor int) ([]*pb.Order, int) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    var batch []*pb.Order
+    for ; cursor < len(s.orderIDs) && len(batch) < exportBatchSize; cursor++ {
+        order := s.orders[s.orderIDs[cursor]]
+        if filter.matches(order) {
+            batch = append(batch, proto.Clone(order).(*pb.Order))
+        }
+    }
+
+    return batch, cursor
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+    "context"
+    "time"
+
+    pb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
+)
+
+// Actors recorded for changes the order service makes on its own.
+const (
+    actorExpirySweeper = "system:expiry-sweeper"
+)
+
+// transition moves order to a new status and appends the change to its
+// history. It must be called with s.mu held for writing.
+func transition(order *pb.Order, to, actor, reason string, at time.Time) {
+    order.History = append(order.History, &pb.StatusTransition{
+        FromStatus: order.Status,
+        ToStatus:   to,
+        ChangedAt:  at.Format(time.RFC3339),
+        Actor:      actor,
+        Reason:     reason,
+    })
+    order.Status = to
+}
+
+func (s *orderService) GetOrderHistory(ctx context.Context, req *pb.GetOrderHistoryRequest) (*pb.GetOrderHistoryResponse, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    order, exists := s.orders[req.OrderId]
+    if !exists {
+        return nil, status.Errorf(codes.NotFound, "order not found")
+    }
+
+    transitions := make([]*pb.StatusTransition, len(order.History))
+    for i, t := range order.History {
+        transitions[i] = proto.Clone(t).(*pb.StatusTransition)
+    }
+
+    return &pb.GetOrderHistoryResponse{Transitions: transitions}, nil
+}
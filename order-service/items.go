@@ -0,0 +1,127 @@
+package main
+
+import (
+    "context"
+    "time"
+
+    pb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
+)
+
+func (s *orderService) AddOrderItem(ctx context.Context, req *pb.AddOrderItemRequest) (*pb.OrderResponse, error) {
+    item := req.Item
+    if item == nil || item.ProductId == "" || item.Quantity <= 0 {
+        return nil, status.Errorf(codes.InvalidArgument, "item with a product and positive quantity is required")
+    }
+
+    return s.editItems(req.OrderId, req.ExpectedVersion, func(items []*pb.OrderItem) ([]*pb.OrderItem, error) {
+        for _, existing := range items {
+            if existing.ProductId == item.ProductId && existing.Price == item.Price {
+                existing.Quantity += item.Quantity
+                return items, nil
+            }
+        }
+        return append(items, proto.Clone(item).(*pb.OrderItem)), nil
+    })
+}
+
+func (s *orderService) RemoveOrderItem(ctx context.Context, req *pb.RemoveOrderItemRequest) (*pb.OrderResponse, error) {
+    if req.LineIndex < 0 {
+        return nil, status.Errorf(codes.InvalidArgument, "line index must not be negative")
+    }
+
+    return s.editItems(req.OrderId, req.ExpectedVersion, func(items []*pb.OrderItem) ([]*pb.OrderItem, error) {
+        i, err := selectLine(items, req.ProductId, req.LineIndex)
+        if err != nil {
+            return nil, err
+        }
+        if len(items) == 1 {
+            return nil, status.Errorf(codes.FailedPrecondition, "cannot remove the last item, cancel the order instead")
+        }
+        return append(items[:i], items[i+1:]...), nil
+    })
+}
+
+func (s *orderService) UpdateOrderItemQuantity(ctx context.Context, req *pb.UpdateOrderItemQuantityRequest) (*pb.OrderResponse, error) {
+    if req.Quantity <= 0 {
+        return nil, status.Errorf(codes.InvalidArgument, "quantity must be positive, use RemoveOrderItem to drop a line")
+    }
+
+    if req.LineIndex < 0 {
+        return nil, status.Errorf(codes.InvalidArgument, "line index must not be negative")
+    }
+
+    return s.editItems(req.OrderId, req.ExpectedVersion, func(items []*pb.OrderItem) ([]*pb.OrderItem, error) {
+        i, err := selectLine(items, req.ProductId, req.LineIndex)
+        if err != nil {
+            return nil, err
+        }
+        items[i].Quantity = req.Quantity
+        return items, nil
+    })
+}
+
+// selectLine finds the line an item edit targets, or says why there is none.
+func selectLine(items []*pb.OrderItem, productID string, lineIndex int32) (int, error) {
+    if i, ok := productLine(items, productID, lineIndex); ok {
+        return i, nil
+    }
+    if _, ok := productLine(items, productID, 0); !ok {
+        return 0, status.Errorf(codes.NotFound, "product %s is not in the order", productID)
+    }
+    return 0, status.Errorf(codes.NotFound, "product %s has no line %d in the order", productID, lineIndex)
+}
+
+// productLine returns the position in items of the lineIndex-th line for
+// productID, counting from 0 in the order the lines appear.
+func productLine(items []*pb.OrderItem, productID string, lineIndex int32) (int, bool) {
+    var n int32
+    for i, item := range items {
+        if item.ProductId != productID {
+            continue
+        }
+        if n == lineIndex {
+            return i, true
+        }
+        n++
+    }
+    return 0, false
+}
+
+// editItems applies edit to a copy of a pending order's items, re-prices the
+// copy and only then replaces the stored order, so a failed edit leaves the
+// order untouched.
+func (s *orderService) editItems(orderID string, expectedVersion int64, edit func([]*pb.OrderItem) ([]*pb.OrderItem, error)) (*pb.OrderResponse, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    stored, exists := s.orders[orderID]
+    if !exists {
+        return nil, status.Errorf(codes.NotFound, "order not found")
+    }
+    if expectedVersion != 0 && expectedVersion != stored.Version {
+        return nil, versionMismatchError(stored.Version)
+    }
+    if stored.Status != "pending" {
+        return nil, status.Errorf(codes.FailedPrecondition, "items can only be changed while the order is pending, order is %s", stored.Status)
+    }
+
+    order := proto.Clone(stored).(*pb.Order)
+    items, err := edit(order.Items)
+    if err != nil {
+        return nil, err
+    }
+    order.Items = items
+
+    if err := s.repriceOrder(order, time.Now()); err != nil {
+        return nil, err
+    }
+    order.Version++
+
+    s.orders[orderID] = order
+    s.enqueueEvent(pb.OrderEventType_ORDER_ITEMS_CHANGED, order)
+
+    return &pb.OrderResponse{Order: proto.Clone(order).(*pb.Order)}, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+    "context"
+    "testing"
+
+    pb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+// TestRemoveOrderItemByLine removes one of two lines of a product and
+// checks the other line stays.
+func TestRemoveOrderItemByLine(t *testing.T) {
+    tests := []struct {
+        name   string
+        req    *pb.RemoveOrderItemRequest
+        code   codes.Code
+        prices []float32
+    }{
+        {name: "first line", req: &pb.RemoveOrderItemRequest{ProductId: "p1"}, prices: []float32{20, 5}},
+        {name: "second line", req: &pb.RemoveOrderItemRequest{ProductId: "p1", LineIndex: 1}, prices: []float32{10, 5}},
+        {name: "other product", req: &pb.RemoveOrderItemRequest{ProductId: "p2"}, prices: []float32{10, 20}},
+        {name: "no such line", req: &pb.RemoveOrderItemRequest{ProductId: "p1", LineIndex: 2}, code: codes.NotFound},
+        {name: "no such product", req: &pb.RemoveOrderItemRequest{ProductId: "p3"}, code: codes.NotFound},
+        {name: "negative line", req: &pb.RemoveOrderItemRequest{ProductId: "p1", LineIndex: -1}, code: codes.InvalidArgument},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            s := newOrderService(fakeUserClient{}, nil, orderServiceConfig{})
+            ctx := context.Background()
+            created, err := s.CreateOrder(ctx, &pb.CreateOrderRequest{
+                UserId: "user_1",
+                Items: []*pb.OrderItem{
+                    {ProductId: "p1", Quantity: 1, Price: 10},
+                    {ProductId: "p1", Quantity: 1, Price: 20},
+                    {ProductId: "p2", Quantity: 1, Price: 5},
+                },
+            })
+            if err != nil {
+                t.Fatalf("CreateOrder: %v", err)
+            }
+
+            tt.req.OrderId = created.Order.Id
+            resp, err := s.RemoveOrderItem(ctx, tt.req)
+            if code := status.Code(err); code != tt.code {
+                t.Fatalf("RemoveOrderItem error = %v, want code %s", err, tt.code)
+            }
+            if err != nil {
+                return
+            }
+
+            var prices []float32
+            for _, item := range resp.Order.Items {
+                prices = append(prices, item.Price)
+            }
+            if len(prices) != len(tt.prices) || prices[0] != tt.prices[0] || prices[1] != tt.prices[1] {
+                t.Errorf("left lines priced %v, want %v", prices, tt.prices)
+            }
+        })
+    }
+}
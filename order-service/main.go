@@ -5,29 +5,68 @@ import (
     "log"
     "net"
 		"os"
+    "os/signal"
+    "strconv"
+    "strings"
     "sync"
+    "syscall"
     "time"
 		"fmt"
 
     pb "github.com/AleksKislov/grpc_microservices_test/proto/order"
 		userPb "github.com/AleksKislov/grpc_microservices_test/proto/user"
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+    "google.golang.org/genproto/googleapis/rpc/errdetails"
     "google.golang.org/grpc"
     "google.golang.org/grpc/codes"
     "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
 )
 
+const defaultCurrency = "USD"
+
 type orderService struct {
     pb.UnimplementedOrderServiceServer
     mu     sync.RWMutex
     orders map[string]*pb.Order
+    // orderIDs lists order IDs in creation order, for stable listing and
+    // resumable export.
+    orderIDs []string
+    // shipmentSeq numbers shipments across all orders.
+    shipmentSeq int
+    coupons map[string]*couponState
+    pricing pricingPipeline
+    config  orderServiceConfig
     userClient userPb.UserServiceClient
+    paymentClient paymentPb.PaymentServiceClient
+
+    // outbox holds events for committed changes that have not been
+    // published yet. It is guarded by mu together with orders.
+    outbox       []*pb.OrderEvent
+    outboxSignal chan struct{}
+}
+
+// orderServiceConfig holds the order service's tunables.
+type orderServiceConfig struct {
+    pricing pricingConfig
+    // pendingTTL is how long a new order may stay pending before the expiry
+    // sweeper cancels it. Zero disables expiry.
+    pendingTTL time.Duration
+    // returnWindow is how long after delivery items may be returned.
+    returnWindow time.Duration
 }
 
-func newOrderService(userClient userPb.UserServiceClient) *orderService {
-    return &orderService{
+func newOrderService(userClient userPb.UserServiceClient, paymentClient paymentPb.PaymentServiceClient, config orderServiceConfig) *orderService {
+    s := &orderService{
         orders: make(map[string]*pb.Order),
+        coupons: make(map[string]*couponState),
+        config: config,
         userClient: userClient,
+        paymentClient: paymentClient,
+        outboxSignal: make(chan struct{}, 1),
     }
+    s.pricing = newPricingPipeline(config.pricing, s.applyCoupons)
+    return s
 }
 
 func (s *orderService) CreateOrder(ctx context.Context, req *pb.CreateOrderRequest) (*pb.OrderResponse, error) {
@@ -45,23 +84,44 @@ func (s *orderService) CreateOrder(ctx context.Context, req *pb.CreateOrderReque
 
     id := fmt.Sprintf("order_%d", len(s.orders)+1)
 
+    now := time.Now()
+
     order := &pb.Order{
         Id:        id,
         UserId:    req.UserId,
-        Items:     req.Items,
-        Status:    "pending",
-        CreatedAt: time.Now().Format(time.RFC3339),
+        Items:     cloneItems(req.Items),
+        CreatedAt: now.Format(time.RFC3339),
+        Version:   1,
+    }
+    transition(order, "pending", req.UserId, "order created", now)
+    if s.config.pendingTTL > 0 {
+        order.ExpiresAt = now.Add(s.config.pendingTTL).Format(time.RFC3339)
     }
 
-    var totalAmount float32
-    for _, item := range req.Items {
-        totalAmount += item.Price * float32(item.Quantity)
+    q, err := s.pricing.price(&cart{
+        userID:      req.UserId,
+        items:       req.Items,
+        couponCodes: req.CouponCodes,
+        region:      req.Region,
+        now:         now,
+    })
+    if err != nil {
+        return nil, err
     }
-    order.TotalAmount = totalAmount
 
+    order.Region = req.Region
+    order.Currency = strings.ToUpper(req.Currency)
+    if order.Currency == "" {
+        order.Currency = defaultCurrency
+    }
+    setPricing(order, q)
+
+    s.redeemCoupons(req.UserId, order.Discounts)
     s.orders[id] = order
+    s.orderIDs = append(s.orderIDs, id)
+    s.enqueueEvent(pb.OrderEventType_ORDER_CREATED, order)
 
-    return &pb.OrderResponse{Order: order}, nil
+    return &pb.OrderResponse{Order: proto.Clone(order).(*pb.Order)}, nil
 }
 
 func (s *orderService) GetOrder(ctx context.Context, req *pb.GetOrderRequest) (*pb.OrderResponse, error) {
@@ -73,42 +133,135 @@ func (s *orderService) GetOrder(ctx context.Context, req *pb.GetOrderRequest) (*
         return nil, status.Errorf(codes.NotFound, "order not found")
     }
 
-    return &pb.OrderResponse{Order: order}, nil
+    return &pb.OrderResponse{Order: proto.Clone(order).(*pb.Order)}, nil
 }
 
 func (s *orderService) UpdateOrder(ctx context.Context, req *pb.UpdateOrderRequest) (*pb.OrderResponse, error) {
     s.mu.Lock()
     defer s.mu.Unlock()
 
-    order, exists := s.orders[req.Id]
+    stored, exists := s.orders[req.Id]
     if !exists {
         return nil, status.Errorf(codes.NotFound, "order not found")
     }
 
-    if req.Status != "" {
-        order.Status = req.Status
+    if req.ExpectedVersion != 0 && req.ExpectedVersion != stored.Version {
+        return nil, versionMismatchError(stored.Version)
+    }
+
+    // Stored orders are never mutated in place: snapshots handed out earlier
+    // may still be serializing on other goroutines.
+    order := proto.Clone(stored).(*pb.Order)
+    if req.Status != "" && req.Status != order.Status {
+        if req.Actor == "" {
+            return nil, status.Errorf(codes.InvalidArgument, "actor is required to change the order status")
+        }
+        transition(order, req.Status, req.Actor, req.Reason, time.Now())
+        // A cancelled order gives its coupons back, however it got there.
+        if req.Status == "cancelled" {
+            s.releaseCoupons(order.UserId, order.Discounts, nil)
+        }
+        order.Version++
+        s.enqueueEvent(statusEventType(req.Status), order)
     }
 
     s.orders[req.Id] = order
 
-    return &pb.OrderResponse{Order: order}, nil
+    return &pb.OrderResponse{Order: proto.Clone(order).(*pb.Order)}, nil
 }
 
+// ListOrders returns one page of the matching orders. Total counts every
+// match, so callers can tell when they have seen them all.
 func (s *orderService) ListOrders(ctx context.Context, req *pb.ListOrdersRequest) (*pb.ListOrdersResponse, error) {
+    if req.Page < 0 || req.Limit < 0 {
+        return nil, status.Errorf(codes.InvalidArgument, "page and limit must not be negative")
+    }
+    filter, err := newOrderFilter(req.UserId, req.Status, req.CreatedAfter, req.CreatedBefore)
+    if err != nil {
+        return nil, err
+    }
+
+    page, limit := int(max(req.Page, 1)), int(req.Limit)
+    if limit == 0 {
+        limit = defaultListLimit
+    }
+    limit = min(limit, maxListLimit)
+    first := (page - 1) * limit
+
     s.mu.RLock()
     defer s.mu.RUnlock()
 
-    var userOrders []*pb.Order
-    for _, order := range s.orders {
-        if order.UserId == req.UserId {
-            userOrders = append(userOrders, order)
+    resp := &pb.ListOrdersResponse{}
+    for _, id := range s.orderIDs {
+        order := s.orders[id]
+        if !filter.matches(order) {
+            continue
+        }
+        if n := int(resp.Total); n >= first && n < first+limit {
+            resp.Orders = append(resp.Orders, proto.Clone(order).(*pb.Order))
         }
+        resp.Total++
     }
 
-    return &pb.ListOrdersResponse{
-        Orders: userOrders,
-        Total:  int32(len(userOrders)),
-    }, nil
+    return resp, nil
+}
+
+func cloneItems(items []*pb.OrderItem) []*pb.OrderItem {
+    cloned := make([]*pb.OrderItem, len(items))
+    for i, item := range items {
+        cloned[i] = proto.Clone(item).(*pb.OrderItem)
+    }
+    return cloned
+}
+
+// versionMismatchError reports a stale write. The current version is carried
+// in the error details so clients can refetch and retry.
+func versionMismatchError(current int64) error {
+    st := status.Newf(codes.Aborted, "order was modified concurrently, current version is %d", current)
+    detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+        Reason: "VERSION_MISMATCH",
+        Domain: "order.OrderService",
+        Metadata: map[string]string{
+            "current_version": strconv.FormatInt(current, 10),
+        },
+    })
+    if err != nil {
+        return st.Err()
+    }
+    return detailed.Err()
+}
+
+// statusEventType picks the event emitted when an order moves to status.
+func statusEventType(status string) pb.OrderEventType {
+    switch status {
+    case "confirmed":
+        return pb.OrderEventType_ORDER_PAID
+    case "cancelled":
+        return pb.OrderEventType_ORDER_CANCELLED
+    case "shipped":
+        return pb.OrderEventType_ORDER_SHIPPED
+    case "delivered":
+        return pb.OrderEventType_ORDER_DELIVERED
+    case "refunded":
+        return pb.OrderEventType_ORDER_REFUNDED
+    case "charged_back":
+        return pb.OrderEventType_ORDER_CHARGED_BACK
+    default:
+        return pb.OrderEventType_ORDER_STATUS_CHANGED
+    }
+}
+
+func newPublisher() (Publisher, error) {
+    switch os.Getenv("ORDER_EVENTS_PUBLISHER") {
+    case "nats":
+        port, err := strconv.Atoi(os.Getenv("NATS_PORT"))
+        if err != nil {
+            port = 4222
+        }
+        return newNATSPublisher(os.Getenv("NATS_HOST"), port)
+    default:
+        return newMemoryPublisher(), nil
+    }
 }
 
 func main() {
@@ -122,17 +275,92 @@ func main() {
 
     userClient := userPb.NewUserServiceClient(userConn)
 
+    paymentConn, err := grpc.Dial(os.Getenv("PAYMENT_SERVICE_ADDR"), grpc.WithInsecure())
+    if err != nil {
+        log.Fatalf("failed to connect to payment service: %v", err)
+    }
+    defer paymentConn.Close()
+
+    paymentClient := paymentPb.NewPaymentServiceClient(paymentConn)
+
     lis, err := net.Listen("tcp", ":50051")
     if err != nil {
         log.Fatalf("failed to listen: %v", err)
     }
 
+    publisher, err := newPublisher()
+    if err != nil {
+        log.Fatalf("failed to create event publisher: %v", err)
+    }
+    defer publisher.Close()
+
+    pricing, err := loadPricingConfig(os.Getenv("PRICING_CONFIG"))
+    if err != nil {
+        log.Fatalf("failed to load pricing config: %v", err)
+    }
+
+    config := orderServiceConfig{
+        pricing:      pricing,
+        pendingTTL:   durationFromEnv("ORDER_PENDING_TTL", 30*time.Minute),
+        returnWindow: durationFromEnv("ORDER_RETURN_WINDOW", 30*24*time.Hour),
+    }
+    sweepInterval := durationFromEnv("ORDER_EXPIRY_SWEEP_INTERVAL", time.Minute)
+
+    service := newOrderService(userClient, paymentClient, config)
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    var workers sync.WaitGroup
+    workers.Add(1)
+    go func() {
+        defer workers.Done()
+        service.runOutboxRelay(ctx, publisher)
+    }()
+    if config.pendingTTL > 0 && sweepInterval > 0 {
+        workers.Add(1)
+        go func() {
+            defer workers.Done()
+            service.runExpirySweeper(ctx, sweepInterval, noopReservations{})
+        }()
+    }
+
     server := grpc.NewServer()
-    pb.RegisterOrderServiceServer(server, newOrderService(userClient))
+    pb.RegisterOrderServiceServer(server, service)
+
+    go func() {
+        <-ctx.Done()
+        log.Println("Shutting down order service")
+        server.GracefulStop()
+    }()
 
     log.Println("Starting order service on :50052")
     if err := server.Serve(lis); err != nil {
         log.Fatalf("failed to serve: %v", err)
     }
+
+    stop()
+    workers.Wait()
+
+    // Give events committed just before shutdown one last chance to go out.
+    flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancelFlush()
+    if err := service.flushOutbox(flushCtx, publisher); err != nil {
+        log.Printf("failed to flush outbox on shutdown: %v", err)
+    }
 }
 
+// durationFromEnv parses a duration such as "30m" from the environment,
+// falling back to def when the variable is unset or invalid.
+func durationFromEnv(key string, def time.Duration) time.Duration {
+    value := os.Getenv(key)
+    if value == "" {
+        return def
+    }
+    d, err := time.ParseDuration(value)
+    if err != nil {
+        log.Printf("invalid %s %q, using %s", key, value, def)
+        return def
+    }
+    return d
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net"
+    "sync"
+    "testing"
+
+    pb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    userPb "github.com/AleksKislov/grpc_microservices_test/proto/user"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/grpc/test/bufconn"
+)
+
+type fakeUserClient struct{}
+
+func (fakeUserClient) CreateUser(ctx context.Context, in *userPb.CreateUserRequest, opts ...grpc.CallOption) (*userPb.UserResponse, error) {
+    return &userPb.UserResponse{User: &userPb.User{Id: "user_1"}}, nil
+}
+
+func (fakeUserClient) GetUser(ctx context.Context, in *userPb.GetUserRequest, opts ...grpc.CallOption) (*userPb.UserResponse, error) {
+    return &userPb.UserResponse{User: &userPb.User{Id: in.Id}}, nil
+}
+
+func (fakeUserClient) AuthenticateUser(ctx context.Context, in *userPb.AuthRequest, opts ...grpc.CallOption) (*userPb.AuthResponse, error) {
+    return &userPb.AuthResponse{}, nil
+}
+
+// startOrderServer serves s over an in-memory listener so responses go
+// through real gRPC serialization.
+func startOrderServer(t *testing.T, s *orderService) pb.OrderServiceClient {
+    t.Helper()
+
+    lis := bufconn.Listen(1 << 20)
+    server := grpc.NewServer()
+    pb.RegisterOrderServiceServer(server, s)
+    go server.Serve(lis)
+    t.Cleanup(server.Stop)
+
+    conn, err := grpc.Dial("bufnet",
+        grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+            return lis.DialContext(ctx)
+        }),
+        grpc.WithInsecure(),
+    )
+    if err != nil {
+        t.Fatalf("failed to dial: %v", err)
+    }
+    t.Cleanup(func() { conn.Close() })
+
+    return pb.NewOrderServiceClient(conn)
+}
+
+// TestConcurrentOrderAccess hammers create, update, get and list at the same
+// time. Run with -race: any handler that hands out or mutates a stored
+// order in place shows up as a data race during serialization.
+func TestConcurrentOrderAccess(t *testing.T) {
+    const (
+        workers    = 8
+        iterations = 100
+    )
+
+    s := newOrderService(fakeUserClient{}, nil, orderServiceConfig{})
+    client := startOrderServer(t, s)
+    ctx := context.Background()
+
+    seed, err := client.CreateOrder(ctx, &pb.CreateOrderRequest{
+        UserId: "user_1",
+        Items:  []*pb.OrderItem{{ProductId: "p1", Quantity: 1, Price: 10}},
+    })
+    if err != nil {
+        t.Fatalf("CreateOrder: %v", err)
+    }
+
+    var wg sync.WaitGroup
+    errs := make(chan error, workers*4)
+    for w := 0; w < workers; w++ {
+        wg.Add(4)
+        go func() {
+            defer wg.Done()
+            for i := 0; i < iterations; i++ {
+                if _, err := client.CreateOrder(ctx, &pb.CreateOrderRequest{
+                    UserId: "user_1",
+                    Items:  []*pb.OrderItem{{ProductId: "p2", Quantity: 2, Price: 5}},
+                }); err != nil {
+                    errs <- fmt.Errorf("CreateOrder: %w", err)
+                    return
+                }
+            }
+        }()
+        go func(w int) {
+            defer wg.Done()
+            for i := 0; i < iterations; i++ {
+                if _, err := client.UpdateOrder(ctx, &pb.UpdateOrderRequest{
+                    Id:     seed.Order.Id,
+                    Status: fmt.Sprintf("status_%d_%d", w, i),
+                    Actor:  "test",
+                }); err != nil {
+                    errs <- fmt.Errorf("UpdateOrder: %w", err)
+                    return
+                }
+            }
+        }(w)
+        go func() {
+            defer wg.Done()
+            for i := 0; i < iterations; i++ {
+                if _, err := client.GetOrder(ctx, &pb.GetOrderRequest{Id: seed.Order.Id}); err != nil {
+                    errs <- fmt.Errorf("GetOrder: %w", err)
+                    return
+                }
+            }
+        }()
+        go func() {
+            defer wg.Done()
+            for i := 0; i < iterations/10; i++ {
+                if _, err := client.ListOrders(ctx, &pb.ListOrdersRequest{UserId: "user_1"}); err != nil {
+                    errs <- fmt.Errorf("ListOrders: %w", err)
+                    return
+                }
+            }
+        }()
+    }
+    wg.Wait()
+    close(errs)
+
+    for err := range errs {
+        t.Error(err)
+    }
+
+    list, err := client.ListOrders(ctx, &pb.ListOrdersRequest{UserId: "user_1"})
+    if err != nil {
+        t.Fatalf("ListOrders: %v", err)
+    }
+    if want := int32(1 + workers*iterations); list.Total != want {
+        t.Errorf("got %d orders, want %d", list.Total, want)
+    }
+
+    got, err := client.GetOrder(ctx, &pb.GetOrderRequest{Id: seed.Order.Id})
+    if err != nil {
+        t.Fatalf("GetOrder: %v", err)
+    }
+    if want := int64(1 + workers*iterations); got.Order.Version != want {
+        t.Errorf("got version %d, want %d", got.Order.Version, want)
+    }
+}
+
+// TestSnapshotsDoNotAlias checks that neither the caller's request nor a
+// returned order shares memory with the stored order.
+func TestSnapshotsDoNotAlias(t *testing.T) {
+    s := newOrderService(fakeUserClient{}, nil, orderServiceConfig{})
+    ctx := context.Background()
+
+    items := []*pb.OrderItem{{ProductId: "p1", Quantity: 1, Price: 10}}
+    created, err := s.CreateOrder(ctx, &pb.CreateOrderRequest{UserId: "user_1", Items: items})
+    if err != nil {
+        t.Fatalf("CreateOrder: %v", err)
+    }
+
+    items[0].Quantity = 99
+    created.Order.Items[0].Price = 0
+    created.Order.Status = "tampered"
+
+    got, err := s.GetOrder(ctx, &pb.GetOrderRequest{Id: created.Order.Id})
+    if err != nil {
+        t.Fatalf("GetOrder: %v", err)
+    }
+    if item := got.Order.Items[0]; item.Quantity != 1 || item.Price != 10 {
+        t.Errorf("stored item changed through an alias: %v", item)
+    }
+    if got.Order.Status != "pending" {
+        t.Errorf("stored status changed through an alias: %s", got.Order.Status)
+    }
+}
+
+// TestListOrdersPages lists every user's orders, which must come back one
+// bounded page at a time.
+func TestListOrdersPages(t *testing.T) {
+    s := newOrderService(fakeUserClient{}, nil, orderServiceConfig{})
+    ctx := context.Background()
+    for i := 0; i < 25; i++ {
+        _, err := s.CreateOrder(ctx, &pb.CreateOrderRequest{
+            UserId: fmt.Sprintf("user_%d", i%2),
+            Items:  []*pb.OrderItem{{ProductId: "p1", Quantity: 1, Price: 10}},
+        })
+        if err != nil {
+            t.Fatalf("CreateOrder: %v", err)
+        }
+    }
+
+    tests := []struct {
+        name   string
+        req    *pb.ListOrdersRequest
+        orders int
+        total  int32
+    }{
+        {name: "default page", req: &pb.ListOrdersRequest{}, orders: 20, total: 25},
+        {name: "second page", req: &pb.ListOrdersRequest{Page: 2}, orders: 5, total: 25},
+        {name: "limit", req: &pb.ListOrdersRequest{Page: 3, Limit: 10}, orders: 5, total: 25},
+        {name: "past the end", req: &pb.ListOrdersRequest{Page: 4, Limit: 10}, orders: 0, total: 25},
+        {name: "one user", req: &pb.ListOrdersRequest{UserId: "user_1"}, orders: 12, total: 12},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            resp, err := s.ListOrders(ctx, tt.req)
+            if err != nil {
+                t.Fatalf("ListOrders: %v", err)
+            }
+            if len(resp.Orders) != tt.orders || resp.Total != tt.total {
+                t.Errorf("got %d of %d orders, want %d of %d", len(resp.Orders), resp.Total, tt.orders, tt.total)
+            }
+        })
+    }
+
+    if _, err := s.ListOrders(ctx, &pb.ListOrdersRequest{Limit: -1}); status.Code(err) != codes.InvalidArgument {
+        t.Errorf("negative limit: got %v, want code %s", err, codes.InvalidArgument)
+    }
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "time"
+
+    pb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    "github.com/nats-io/nats-server/v2/server"
+    "github.com/nats-io/nats.go"
+    "google.golang.org/protobuf/proto"
+)
+
+// natsPublisher publishes events to an embedded NATS server so other
+// services can subscribe to "orders.>" without running a separate broker.
+type natsPublisher struct {
+    server *server.Server
+    conn   *nats.Conn
+}
+
+func newNATSPublisher(host string, port int) (*natsPublisher, error) {
+    ns, err := server.NewServer(&server.Options{
+        Host:   host,
+        Port:   port,
+        NoSigs: true,
+    })
+    if err != nil {
+        return nil, fmt.Errorf("failed to create nats server: %w", err)
+    }
+
+    go ns.Start()
+    if !ns.ReadyForConnections(5 * time.Second) {
+        ns.Shutdown()
+        return nil, fmt.Errorf("nats server did not start")
+    }
+
+    conn, err := nats.Connect(ns.ClientURL())
+    if err != nil {
+        ns.Shutdown()
+        return nil, fmt.Errorf("failed to connect to nats: %w", err)
+    }
+
+    return &natsPublisher{server: ns, conn: conn}, nil
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, event *pb.OrderEvent) error {
+    data, err := proto.Marshal(event)
+    if err != nil {
+        return err
+    }
+
+    msg := nats.NewMsg(eventSubject(event))
+    msg.Data = data
+    // Consumers deduplicate on this header, since the outbox may redeliver
+    // an event after a failed flush.
+    msg.Header.Set(nats.MsgIdHdr, event.Id)
+
+    if err := p.conn.PublishMsg(msg); err != nil {
+        return err
+    }
+
+    // Flush so the relay only drops the event from the outbox once the
+    // server has actually received it.
+    return p.conn.FlushWithContext(ctx)
+}
+
+func (p *natsPublisher) Close() error {
+    p.conn.Close()
+    p.server.Shutdown()
+    return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "time"
+
+    pb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    "github.com/google/uuid"
+    "google.golang.org/protobuf/proto"
+)
+
+const (
+    outboxBatchSize    = 100
+    outboxPollInterval = time.Second
+    outboxMaxBackoff   = 30 * time.Second
+)
+
+// enqueueEvent records an event in the outbox. It must be called with s.mu
+// held for writing, in the same critical section as the change the event
+// describes, so an event exists if and only if the change was committed.
+func (s *orderService) enqueueEvent(eventType pb.OrderEventType, order *pb.Order) {
+    s.outbox = append(s.outbox, &pb.OrderEvent{
+        Id:         uuid.New().String(),
+        Type:       eventType,
+        OrderId:    order.Id,
+        UserId:     order.UserId,
+        Order:      proto.Clone(order).(*pb.Order),
+        OccurredAt: time.Now().Format(time.RFC3339),
+    })
+
+    select {
+    case s.outboxSignal <- struct{}{}:
+    default:
+    }
+}
+
+// runOutboxRelay publishes outbox events in order until ctx is cancelled.
+// An event is removed only after the publisher accepted it, so delivery is
+// at-least-once and consumers should deduplicate on the event ID.
+func (s *orderService) runOutboxRelay(ctx context.Context, publisher Publisher) {
+    ticker := time.NewTicker(outboxPollInterval)
+    defer ticker.Stop()
+
+    backoff := outboxPollInterval
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-s.outboxSignal:
+        case <-ticker.C:
+        }
+
+        if err := s.relayOutbox(ctx, publisher); err != nil {
+            log.Printf("outbox relay: %v (retrying in %s)", err, backoff)
+            select {
+            case <-ctx.Done():
+                return
+            case <-time.After(backoff):
+            }
+            backoff *= 2
+            if backoff > outboxMaxBackoff {
+                backoff = outboxMaxBackoff
+            }
+            continue
+        }
+        backoff = outboxPollInterval
+    }
+}
+
+// relayOutbox publishes one batch of pending events. The lock is not held
+// while publishing, so a slow broker never blocks request handlers.
+func (s *orderService) relayOutbox(ctx context.Context, publisher Publisher) error {
+    s.mu.RLock()
+    n := len(s.outbox)
+    if n > outboxBatchSize {
+        n = outboxBatchSize
+    }
+    batch := make([]*pb.OrderEvent, n)
+    copy(batch, s.outbox)
+    s.mu.RUnlock()
+
+    for i, event := range batch {
+        if err := publisher.Publish(ctx, event); err != nil {
+            s.ackOutbox(i)
+            return err
+        }
+    }
+    s.ackOutbox(len(batch))
+
+    return nil
+}
+
+// flushOutbox relays batches until the outbox is empty, a publish fails or
+// ctx expires.
+func (s *orderService) flushOutbox(ctx context.Context, publisher Publisher) error {
+    for {
+        s.mu.RLock()
+        pending := len(s.outbox)
+        s.mu.RUnlock()
+        if pending == 0 {
+            return nil
+        }
+        if err := ctx.Err(); err != nil {
+            return fmt.Errorf("%d events left: %w", pending, err)
+        }
+
+        if err := s.relayOutbox(ctx, publisher); err != nil {
+            return err
+        }
+    }
+}
+
+// ackOutbox drops the first n events, which have been published. Only the
+// relay removes entries, so the head of the queue is still the same batch.
+func (s *orderService) ackOutbox(n int) {
+    if n == 0 {
+        return
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.outbox = s.outbox[n:]
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "slices"
+    "strings"
+    "time"
+
+    pb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
+)
+
+// amountTolerance absorbs float32 rounding when comparing money amounts.
+const amountTolerance = 0.005
+
+func (s *orderService) RecordPayment(ctx context.Context, req *pb.RecordPaymentRequest) (*pb.OrderResponse, error) {
+    if req.Amount <= 0 {
+        return nil, status.Errorf(codes.InvalidArgument, "payment amount must be positive")
+    }
+    if req.Actor == "" {
+        return nil, status.Errorf(codes.InvalidArgument, "actor is required")
+    }
+    if req.PaymentId == "" {
+        return nil, status.Errorf(codes.InvalidArgument, "payment_id is required")
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    stored, exists := s.orders[req.OrderId]
+    if !exists {
+        return nil, status.Errorf(codes.NotFound, "order not found")
+    }
+    for _, recordID := range stored.PaymentRecordIds {
+        if req.RecordId != "" && recordID == req.RecordId {
+            return &pb.OrderResponse{Order: proto.Clone(stored).(*pb.Order)}, nil
+        }
+    }
+    if !strings.EqualFold(req.Currency, stored.Currency) {
+        return nil, status.Errorf(codes.FailedPrecondition, "payment currency %s does not match order currency %s", req.Currency, stored.Currency)
+    }
+
+    order := proto.Clone(stored).(*pb.Order)
+    var err error
+    switch req.Kind {
+    case pb.PaymentRecordKind_PAYMENT_AUTHORIZED:
+        err = s.recordAuthorization(order, req)
+    case pb.PaymentRecordKind_AUTHORIZATION_RELEASED:
+        s.recordRelease(order, req)
+    default:
+        err = s.recordCapture(order, req)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    if req.RecordId != "" {
+        order.PaymentRecordIds = append(order.PaymentRecordIds, req.RecordId)
+    }
+    if !slices.Contains(order.PaymentIds, req.PaymentId) {
+        order.PaymentIds = append(order.PaymentIds, req.PaymentId)
+    }
+    order.Version++
+    s.orders[order.Id] = order
+
+    return &pb.OrderResponse{Order: proto.Clone(order).(*pb.Order)}, nil
+}
+
+// recordAuthorization adds a hold to the order. An order whose balance is
+// fully held moves to "authorized", which is enough to ship it.
+func (s *orderService) recordAuthorization(order *pb.Order, req *pb.RecordPaymentRequest) error {
+    if order.Status != "pending" && order.Status != "partially_paid" {
+        return status.Errorf(codes.FailedPrecondition, "order is %s and cannot be paid", order.Status)
+    }
+    if outstanding := outstandingBalance(order); req.Amount > outstanding+amountTolerance {
+        return status.Errorf(codes.FailedPrecondition, "authorization of %.2f exceeds the outstanding balance of %.2f", req.Amount, outstanding)
+    }
+
+    order.AmountAuthorized = roundCents(order.AmountAuthorized + req.Amount)
+    if outstandingBalance(order) <= amountTolerance {
+        transition(order, "authorized", req.Actor, fmt.Sprintf("payment %s authorized", req.PaymentId), time.Now())
+        s.enqueueEvent(pb.OrderEventType_ORDER_STATUS_CHANGED, order)
+    }
+    return nil
+}
+
+// recordCapture moves money into amount_paid. Captures may arrive after the
+// order shipped, so only unpaid statuses move to "confirmed".
+func (s *orderService) recordCapture(order *pb.Order, req *pb.RecordPaymentRequest) error {
+    switch order.Status {
+    case "pending", "partially_paid", "authorized", "shipped", "delivered":
+    default:
+        return status.Errorf(codes.FailedPrecondition, "order is %s and cannot be paid", order.Status)
+    }
+    if unpaid := unpaidBalance(order); req.Amount > unpaid+amountTolerance {
+        return status.Errorf(codes.FailedPrecondition, "payment of %.2f exceeds the unpaid balance of %.2f", req.Amount, unpaid)
+    }
+
+    order.AmountPaid = roundCents(order.AmountPaid + req.Amount)
+    if req.FromAuthorization {
+        order.AmountAuthorized = roundCents(max(order.AmountAuthorized-req.Amount, 0))
+    }
+
+    now := time.Now()
+    switch {
+    case unpaidBalance(order) <= amountTolerance:
+        if order.Status == "pending" || order.Status == "partially_paid" || order.Status == "authorized" {
+            transition(order, "confirmed", req.Actor, fmt.Sprintf("payment %s completed", req.PaymentId), now)
+        }
+        s.enqueueEvent(pb.OrderEventType_ORDER_PAID, order)
+    case order.Status == "pending":
+        transition(order, "partially_paid", req.Actor, fmt.Sprintf("partial payment %s completed", req.PaymentId), now)
+        s.enqueueEvent(pb.OrderEventType_ORDER_STATUS_CHANGED, order)
+    }
+    return nil
+}
+
+// recordRelease drops a hold that was voided or expired. An authorized order
+// that is no longer fully covered goes back to awaiting payment.
+func (s *orderService) recordRelease(order *pb.Order, req *pb.RecordPaymentRequest) {
+    order.AmountAuthorized = roundCents(max(order.AmountAuthorized-req.Amount, 0))
+    if order.Status != "authorized" || outstandingBalance(order) <= amountTolerance {
+        return
+    }
+
+    to := "pending"
+    if order.AmountPaid > 0 {
+        to = "partially_paid"
+    }
+    transition(order, to, req.Actor, fmt.Sprintf("authorization of payment %s released", req.PaymentId), time.Now())
+    s.enqueueEvent(pb.OrderEventType_ORDER_STATUS_CHANGED, order)
+}
+
+// outstandingBalance is what is neither paid nor held.
+func outstandingBalance(order *pb.Order) float32 {
+    return roundCents(order.TotalAmount - order.AmountPaid - order.AmountAuthorized)
+}
+
+func unpaidBalance(order *pb.Order) float32 {
+    return roundCents(order.TotalAmount - order.AmountPaid)
+}
+
+func (s *orderService) RecordRefund(ctx context.Context, req *pb.RecordRefundRequest) (*pb.OrderResponse, error) {
+    if req.Amount <= 0 || req.RefundId == "" {
+        return nil, status.Errorf(codes.InvalidArgument, "refund_id and a positive amount are required")
+    }
+    if req.Actor == "" {
+        return nil, status.Errorf(codes.InvalidArgument, "actor is required")
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    stored, exists := s.orders[req.OrderId]
+    if !exists {
+        return nil, status.Errorf(codes.NotFound, "order not found")
+    }
+    for _, refundID := range stored.RefundIds {
+        if refundID == req.RefundId {
+            return &pb.OrderResponse{Order: proto.Clone(stored).(*pb.Order)}, nil
+        }
+    }
+    if !strings.EqualFold(req.Currency, stored.Currency) {
+        return nil, status.Errorf(codes.FailedPrecondition, "refund currency %s does not match order currency %s", req.Currency, stored.Currency)
+    }
+    if refundable := roundCents(stored.AmountPaid - stored.AmountRefunded - stored.AmountChargedBack); req.Amount > refundable+amountTolerance {
+        return nil, status.Errorf(codes.FailedPrecondition, "refund of %.2f exceeds the %.2f paid and not refunded", req.Amount, refundable)
+    }
+
+    order := proto.Clone(stored).(*pb.Order)
+    order.AmountRefunded = roundCents(order.AmountRefunded + req.Amount)
+    order.RefundIds = append(order.RefundIds, req.RefundId)
+    order.Version++
+
+    if order.AmountRefunded >= order.AmountPaid-amountTolerance && order.Status != "refunded" {
+        reason := fmt.Sprintf("refund %s: %s", req.RefundId, req.Reason)
+        transition(order, "refunded", req.Actor, reason, time.Now())
+        s.enqueueEvent(pb.OrderEventType_ORDER_REFUNDED, order)
+    }
+    s.orders[order.Id] = order
+
+    return &pb.OrderResponse{Order: proto.Clone(order).(*pb.Order)}, nil
+}
+
+// RecordChargeback applies a dispute the payment service lost: the money
+// went back to the customer through their bank rather than as a refund.
+// The order becomes "charged_back" once refunds and chargebacks together
+// cover everything paid.
+func (s *orderService) RecordChargeback(ctx context.Context, req *pb.RecordChargebackRequest) (*pb.OrderResponse, error) {
+    if req.Amount <= 0 || req.DisputeId == "" {
+        return nil, status.Errorf(codes.InvalidArgument, "dispute_id and a positive amount are required")
+    }
+    if req.Actor == "" {
+        return nil, status.Errorf(codes.InvalidArgument, "actor is required")
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    stored, exists := s.orders[req.OrderId]
+    if !exists {
+        return nil, status.Errorf(codes.NotFound, "order not found")
+    }
+    if slices.Contains(stored.ChargebackIds, req.DisputeId) {
+        return &pb.OrderResponse{Order: proto.Clone(stored).(*pb.Order)}, nil
+    }
+    if !strings.EqualFold(req.Currency, stored.Currency) {
+        return nil, status.Errorf(codes.FailedPrecondition, "chargeback currency %s does not match order currency %s", req.Currency, stored.Currency)
+    }
+    if remaining := roundCents(stored.AmountPaid - stored.AmountRefunded - stored.AmountChargedBack); req.Amount > remaining+amountTolerance {
+        return nil, status.Errorf(codes.FailedPrecondition, "chargeback of %.2f exceeds the %.2f paid and not refunded", req.Amount, remaining)
+    }
+
+    order := proto.Clone(stored).(*pb.Order)
+    order.AmountChargedBack = roundCents(order.AmountChargedBack + req.Amount)
+    order.ChargebackIds = append(order.ChargebackIds, req.DisputeId)
+    order.Version++
+
+    returned := order.AmountRefunded + order.AmountChargedBack
+    if returned >= order.AmountPaid-amountTolerance && order.Status != "charged_back" {
+        reason := fmt.Sprintf("dispute %s lost: %s", req.DisputeId, req.Reason)
+        transition(order, "charged_back", req.Actor, reason, time.Now())
+        s.enqueueEvent(pb.OrderEventType_ORDER_CHARGED_BACK, order)
+    }
+    s.orders[order.Id] = order
+
+    return &pb.OrderResponse{Order: proto.Clone(order).(*pb.Order)}, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+    "context"
+    "testing"
+
+    pb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+func TestRecordPaymentRequiresPaymentID(t *testing.T) {
+    s := newOrderService(fakeUserClient{}, nil, orderServiceConfig{})
+    ctx := context.Background()
+    created, err := s.CreateOrder(ctx, &pb.CreateOrderRequest{
+        UserId: "user_1",
+        Items:  []*pb.OrderItem{{ProductId: "p1", Quantity: 1, Price: 10}},
+    })
+    if err != nil {
+        t.Fatalf("CreateOrder: %v", err)
+    }
+
+    tests := []struct {
+        name      string
+        paymentID string
+        code      codes.Code
+    }{
+        {name: "missing payment ID", code: codes.InvalidArgument},
+        {name: "with payment ID", paymentID: "payment_1"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            resp, err := s.RecordPayment(ctx, &pb.RecordPaymentRequest{
+                OrderId:   created.Order.Id,
+                PaymentId: tt.paymentID,
+                Amount:    10,
+                Currency:  created.Order.Currency,
+                Actor:     "payment-service",
+                Kind:      pb.PaymentRecordKind_PAYMENT_CAPTURED,
+            })
+            if code := status.Code(err); code != tt.code {
+                t.Fatalf("RecordPayment error = %v, want code %s", err, tt.code)
+            }
+            if err == nil && resp.Order.AmountPaid != 10 {
+                t.Errorf("order has %.2f paid, want 10", resp.Order.AmountPaid)
+            }
+        })
+    }
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "math"
+    "os"
+    "time"
+
+    pb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+// pricingConfig holds the shipping and tax rules. It is loaded from the JSON
+// file named by PRICING_CONFIG; the zero value charges no shipping or tax.
+type pricingConfig struct {
+    Shipping shippingConfig     `json:"shipping"`
+    TaxRates map[string]taxRate `json:"tax_rates"`
+}
+
+type shippingConfig struct {
+    // Mode is "flat", "weight" or empty for no shipping charge.
+    Mode     string  `json:"mode"`
+    FlatRate float32 `json:"flat_rate"`
+    BaseRate float32 `json:"base_rate"`
+    PerKg    float32 `json:"per_kg"`
+    // FreeOver waives shipping when the discounted subtotal reaches it.
+    FreeOver float32 `json:"free_over"`
+}
+
+type taxRate struct {
+    Rate      float32 `json:"rate"`
+    Inclusive bool    `json:"inclusive"`
+}
+
+func loadPricingConfig(path string) (pricingConfig, error) {
+    var config pricingConfig
+    if path == "" {
+        return config, nil
+    }
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return config, err
+    }
+    if err := json.Unmarshal(data, &config); err != nil {
+        return config, fmt.Errorf("failed to parse %s: %w", path, err)
+    }
+
+    switch config.Shipping.Mode {
+    case "", "flat", "weight":
+    default:
+        return config, fmt.Errorf("unknown shipping mode %q", config.Shipping.Mode)
+    }
+
+    return config, nil
+}
+
+// cart is the input to the pricing pipeline.
+type cart struct {
+    userID      string
+    items       []*pb.OrderItem
+    couponCodes []string
+    region      string
+    now         time.Time
+    // redeemed is set when re-pricing an existing order whose coupons have
+    // already been redeemed.
+    redeemed bool
+}
+
+// quote accumulates the result as a cart moves through the stages.
+type quote struct {
+    breakdown *pb.PriceBreakdown
+    discounts []*pb.DiscountLine
+}
+
+// pricingStage is one step of the pricing pipeline. Stages run in order and
+// each records what it contributed in the breakdown's components.
+type pricingStage interface {
+    price(c *cart, q *quote) error
+}
+
+type pricingPipeline []pricingStage
+
+func newPricingPipeline(config pricingConfig, applyCoupons couponApplier) pricingPipeline {
+    return pricingPipeline{
+        subtotalStage{},
+        discountStage{apply: applyCoupons},
+        shippingStage{config: config.Shipping},
+        taxStage{rates: config.TaxRates},
+    }
+}
+
+func (p pricingPipeline) price(c *cart) (*quote, error) {
+    q := &quote{breakdown: &pb.PriceBreakdown{}}
+    for _, stage := range p {
+        if err := stage.price(c, q); err != nil {
+            return nil, err
+        }
+    }
+
+    b := q.breakdown
+    b.Total = roundCents(b.Subtotal - b.DiscountTotal + b.Shipping)
+    if !b.TaxInclusive {
+        b.Total = roundCents(b.Total + b.Tax)
+    }
+
+    return q, nil
+}
+
+type subtotalStage struct{}
+
+func (subtotalStage) price(c *cart, q *quote) error {
+    var subtotal float32
+    for _, item := range c.items {
+        subtotal += item.Price * float32(item.Quantity)
+    }
+
+    q.breakdown.Subtotal = roundCents(subtotal)
+    q.breakdown.Components = append(q.breakdown.Components, &pb.PriceComponent{
+        Stage:       "subtotal",
+        Description: fmt.Sprintf("%d line items", len(c.items)),
+        Amount:      q.breakdown.Subtotal,
+    })
+    return nil
+}
+
+// couponApplier validates a cart's coupon codes and returns the discounts
+// they produce, without redeeming them.
+type couponApplier func(c *cart, subtotal float32) ([]*pb.DiscountLine, error)
+
+type discountStage struct {
+    apply couponApplier
+}
+
+func (s discountStage) price(c *cart, q *quote) error {
+    discounts, err := s.apply(c, q.breakdown.Subtotal)
+    if err != nil {
+        return err
+    }
+
+    for _, discount := range discounts {
+        discount.Amount = roundCents(discount.Amount)
+        q.breakdown.DiscountTotal += discount.Amount
+        q.breakdown.Components = append(q.breakdown.Components, &pb.PriceComponent{
+            Stage:       "discount",
+            Description: discount.CouponCode + ": " + discount.Description,
+            Amount:      -discount.Amount,
+        })
+    }
+    q.discounts = discounts
+    return nil
+}
+
+type shippingStage struct {
+    config shippingConfig
+}
+
+func (s shippingStage) price(c *cart, q *quote) error {
+    var amount float32
+    var description string
+
+    switch s.config.Mode {
+    case "flat":
+        amount = s.config.FlatRate
+        description = "flat rate"
+    case "weight":
+        var weight float32
+        for _, item := range c.items {
+            weight += item.Weight * float32(item.Quantity)
+        }
+        amount = s.config.BaseRate + s.config.PerKg*weight
+        description = fmt.Sprintf("%.2f kg", weight)
+    case "":
+        return nil
+    default:
+        return status.Errorf(codes.Internal, "unknown shipping mode %q", s.config.Mode)
+    }
+
+    if s.config.FreeOver > 0 && q.breakdown.Subtotal-q.breakdown.DiscountTotal >= s.config.FreeOver {
+        amount = 0
+        description = fmt.Sprintf("free over %.2f", s.config.FreeOver)
+    }
+
+    q.breakdown.Shipping = roundCents(amount)
+    q.breakdown.Components = append(q.breakdown.Components, &pb.PriceComponent{
+        Stage:       "shipping",
+        Description: description,
+        Amount:      q.breakdown.Shipping,
+    })
+    return nil
+}
+
+// taxStage taxes the discounted goods total at the cart region's rate.
+// Shipping is not taxed.
+type taxStage struct {
+    rates map[string]taxRate
+}
+
+func (s taxStage) price(c *cart, q *quote) error {
+    rate, ok := s.rates[c.region]
+    if !ok || rate.Rate == 0 {
+        return nil
+    }
+
+    taxable := q.breakdown.Subtotal - q.breakdown.DiscountTotal
+    var tax float32
+    if rate.Inclusive {
+        tax = taxable - taxable/(1+rate.Rate)
+    } else {
+        tax = taxable * rate.Rate
+    }
+
+    q.breakdown.Tax = roundCents(tax)
+    q.breakdown.TaxInclusive = rate.Inclusive
+
+    description := fmt.Sprintf("%s %g%%", c.region, rate.Rate*100)
+    if rate.Inclusive {
+        description += " (included)"
+    }
+    q.breakdown.Components = append(q.breakdown.Components, &pb.PriceComponent{
+        Stage:       "tax",
+        Description: description,
+        Amount:      q.breakdown.Tax,
+    })
+    return nil
+}
+
+// setPricing copies a quote onto an order.
+func setPricing(order *pb.Order, q *quote) {
+    order.Pricing = q.breakdown
+    order.Discounts = q.discounts
+    order.SubtotalAmount = q.breakdown.Subtotal
+    order.TotalAmount = q.breakdown.Total
+}
+
+// repriceOrder recomputes an existing order's totals after its items changed,
+// using the same pipeline as CreateOrder. It must be called with s.mu held.
+func (s *orderService) repriceOrder(order *pb.Order, now time.Time) error {
+    q, err := s.pricing.price(&cart{
+        userID:      order.UserId,
+        items:       order.Items,
+        couponCodes: couponCodes(order.Discounts),
+        region:      order.Region,
+        now:         now,
+        redeemed:    true,
+    })
+    if err != nil {
+        return err
+    }
+
+    s.releaseCoupons(order.UserId, order.Discounts, q.discounts)
+    setPricing(order, q)
+    return nil
+}
+
+func roundCents(amount float32) float32 {
+    return float32(math.Round(float64(amount)*100) / 100)
+}
+
+func (s *orderService) QuoteOrder(ctx context.Context, req *pb.QuoteOrderRequest) (*pb.QuoteOrderResponse, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    q, err := s.pricing.price(&cart{
+        userID:      req.UserId,
+        items:       req.Items,
+        couponCodes: req.CouponCodes,
+        region:      req.Region,
+        now:         time.Now(),
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return &pb.QuoteOrderResponse{
+        Pricing:   q.breakdown,
+        Discounts: q.discounts,
+    }, nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "time"
+
+    pb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
+)
+
+func (s *orderService) RequestReturn(ctx context.Context, req *pb.RequestReturnRequest) (*pb.ReturnResponse, error) {
+    if len(req.Items) == 0 {
+        return nil, status.Errorf(codes.InvalidArgument, "at least one item is required")
+    }
+    if req.Actor == "" {
+        return nil, status.Errorf(codes.InvalidArgument, "actor is required")
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    stored, exists := s.orders[req.OrderId]
+    if !exists {
+        return nil, status.Errorf(codes.NotFound, "order not found")
+    }
+    if stored.Status != "delivered" {
+        return nil, status.Errorf(codes.FailedPrecondition, "only delivered orders can be returned, order is %s", stored.Status)
+    }
+
+    now := time.Now()
+    deliveredAt, ok := lastTransitionTo(stored, "delivered")
+    if !ok || now.After(deliveredAt.Add(s.config.returnWindow)) {
+        return nil, status.Errorf(codes.FailedPrecondition, "the return window of %s has closed", s.config.returnWindow)
+    }
+
+    returnable := returnableQuantities(stored)
+    for _, item := range req.Items {
+        if item.Quantity <= 0 {
+            return nil, status.Errorf(codes.InvalidArgument, "quantity for %s must be positive", item.ProductId)
+        }
+        line, ok := productLine(stored.Items, item.ProductId, item.LineIndex)
+        if !ok {
+            return nil, status.Errorf(codes.FailedPrecondition, "product %s has no line %d in the order", item.ProductId, item.LineIndex)
+        }
+        if item.Quantity > returnable[line] {
+            return nil, status.Errorf(codes.FailedPrecondition, "only %d of %s can be returned", returnable[line], item.ProductId)
+        }
+        returnable[line] -= item.Quantity
+    }
+
+    order := proto.Clone(stored).(*pb.Order)
+    orderReturn := &pb.OrderReturn{
+        Id:          fmt.Sprintf("%s_return_%d", order.Id, len(order.ReturnRequests)+1),
+        OrderId:     order.Id,
+        Reason:      req.Reason,
+        Status:      "requested",
+        RequestedAt: now.Format(time.RFC3339),
+        UpdatedAt:   now.Format(time.RFC3339),
+    }
+    for _, item := range req.Items {
+        orderReturn.Items = append(orderReturn.Items, proto.Clone(item).(*pb.ReturnItem))
+    }
+
+    order.ReturnRequests = append(order.ReturnRequests, orderReturn)
+    order.Version++
+    s.orders[order.Id] = order
+
+    return returnResponse(order, orderReturn), nil
+}
+
+func (s *orderService) ApproveReturn(ctx context.Context, req *pb.ReturnActionRequest) (*pb.ReturnResponse, error) {
+    return s.advanceReturn(req, "requested", "approved")
+}
+
+func (s *orderService) RejectReturn(ctx context.Context, req *pb.ReturnActionRequest) (*pb.ReturnResponse, error) {
+    return s.advanceReturn(req, "requested", "rejected")
+}
+
+func (s *orderService) ReceiveReturn(ctx context.Context, req *pb.ReturnActionRequest) (*pb.ReturnResponse, error) {
+    return s.advanceReturn(req, "approved", "received")
+}
+
+// RefundReturn marks a received return as refunding, calls the payment
+// service without holding the lock, and then records the outcome. A failed
+// refund puts the return back to received so it can be retried. The return
+// is the refund's idempotency key, so a refund that went through despite
+// the error is not made again.
+func (s *orderService) RefundReturn(ctx context.Context, req *pb.ReturnActionRequest) (*pb.ReturnResponse, error) {
+    resp, err := s.advanceReturn(req, "received", "refunding")
+    if err != nil {
+        return nil, err
+    }
+    amount := resp.OrderReturn.RefundAmount
+
+    refund, err := s.paymentClient.RefundPayment(ctx, &paymentPb.RefundPaymentRequest{
+        OrderId:        req.OrderId,
+        Amount:         amount,
+        Reason:         fmt.Sprintf("return %s", req.ReturnId),
+        IdempotencyKey: fmt.Sprintf("return:%s:%s", req.OrderId, req.ReturnId),
+    })
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    order, orderReturn, lookupErr := s.findReturn(req.OrderId, req.ReturnId)
+    if lookupErr != nil {
+        return nil, lookupErr
+    }
+    order = proto.Clone(order).(*pb.Order)
+    orderReturn = findOrderReturn(order, req.ReturnId)
+    now := time.Now()
+
+    if err != nil {
+        orderReturn.Status = "received"
+        orderReturn.UpdatedAt = now.Format(time.RFC3339)
+        s.orders[order.Id] = order
+        return nil, status.Errorf(codes.Unavailable, "refund failed, the return can be retried: %v", err)
+    }
+
+    orderReturn.Status = "refunded"
+    orderReturn.RefundId = refund.RefundId
+    orderReturn.RefundIds = nil
+    for _, r := range refund.Refunds {
+        orderReturn.RefundIds = append(orderReturn.RefundIds, r.Id)
+    }
+    orderReturn.UpdatedAt = now.Format(time.RFC3339)
+    order.Version++
+
+    // RecordRefund may already have marked a fully refunded order as
+    // refunded while the payment service processed this return.
+    if order.Status == "delivered" && allItemsRefunded(order) {
+        transition(order, "returned", req.Actor, "all items returned and refunded", now)
+        s.enqueueEvent(statusEventType("returned"), order)
+    }
+    s.orders[order.Id] = order
+
+    return returnResponse(order, orderReturn), nil
+}
+
+// advanceReturn moves a return from one status to the next. Entering
+// "refunding" also fixes the refund amount.
+func (s *orderService) advanceReturn(req *pb.ReturnActionRequest, from, to string) (*pb.ReturnResponse, error) {
+    if req.Actor == "" {
+        return nil, status.Errorf(codes.InvalidArgument, "actor is required")
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    stored, _, err := s.findReturn(req.OrderId, req.ReturnId)
+    if err != nil {
+        return nil, err
+    }
+
+    order := proto.Clone(stored).(*pb.Order)
+    orderReturn := findOrderReturn(order, req.ReturnId)
+    if orderReturn.Status != from {
+        return nil, status.Errorf(codes.FailedPrecondition, "return is %s, expected %s", orderReturn.Status, from)
+    }
+
+    orderReturn.Status = to
+    orderReturn.UpdatedAt = time.Now().Format(time.RFC3339)
+    if req.Note != "" {
+        orderReturn.Note = req.Note
+    }
+    if to == "refunding" {
+        orderReturn.RefundAmount = returnRefundAmount(order, orderReturn)
+    }
+    order.Version++
+    s.orders[order.Id] = order
+
+    return returnResponse(order, orderReturn), nil
+}
+
+// findReturn must be called with s.mu held.
+func (s *orderService) findReturn(orderID, returnID string) (*pb.Order, *pb.OrderReturn, error) {
+    order, exists := s.orders[orderID]
+    if !exists {
+        return nil, nil, status.Errorf(codes.NotFound, "order not found")
+    }
+    orderReturn := findOrderReturn(order, returnID)
+    if orderReturn == nil {
+        return nil, nil, status.Errorf(codes.NotFound, "return not found")
+    }
+    return order, orderReturn, nil
+}
+
+func findOrderReturn(order *pb.Order, returnID string) *pb.OrderReturn {
+    for _, orderReturn := range order.ReturnRequests {
+        if orderReturn.Id == returnID {
+            return orderReturn
+        }
+    }
+    return nil
+}
+
+// returnRefundAmount is the returned items' share of what the customer paid
+// for goods: their list value scaled by (total - shipping) / subtotal, which
+// spreads discounts and exclusive tax proportionally. Shipping is not
+// refunded. The amount is capped so that all refunds together never exceed
+// the goods total.
+func returnRefundAmount(order *pb.Order, orderReturn *pb.OrderReturn) float32 {
+    subtotal := order.SubtotalAmount
+    if subtotal <= 0 {
+        return 0
+    }
+
+    var value float32
+    for _, item := range orderReturn.Items {
+        if line, ok := productLine(order.Items, item.ProductId, item.LineIndex); ok {
+            value += order.Items[line].Price * float32(item.Quantity)
+        }
+    }
+
+    var shipping float32
+    if order.Pricing != nil {
+        shipping = order.Pricing.Shipping
+    }
+    goodsTotal := order.TotalAmount - shipping
+    amount := roundCents(goodsTotal * value / subtotal)
+
+    var refunded float32
+    for _, other := range order.ReturnRequests {
+        if other.Id != orderReturn.Id && (other.Status == "refunding" || other.Status == "refunded") {
+            refunded += other.RefundAmount
+        }
+    }
+    if remaining := roundCents(goodsTotal - refunded); amount > remaining {
+        amount = remaining
+    }
+
+    return amount
+}
+
+// returnableQuantities returns, per position in the order's items, how
+// many units are not yet covered by a return that is still open or was
+// completed.
+func returnableQuantities(order *pb.Order) map[int]int32 {
+    returnable := make(map[int]int32)
+    for i, item := range order.Items {
+        returnable[i] = item.Quantity
+    }
+    for _, orderReturn := range order.ReturnRequests {
+        if orderReturn.Status == "rejected" {
+            continue
+        }
+        for _, item := range orderReturn.Items {
+            if line, ok := productLine(order.Items, item.ProductId, item.LineIndex); ok {
+                returnable[line] -= item.Quantity
+            }
+        }
+    }
+    return returnable
+}
+
+func allItemsRefunded(order *pb.Order) bool {
+    remaining := make(map[string]int32)
+    for _, item := range order.Items {
+        remaining[item.ProductId] += item.Quantity
+    }
+    for _, orderReturn := range order.ReturnRequests {
+        if orderReturn.Status != "refunded" {
+            continue
+        }
+        for _, item := range orderReturn.Items {
+            remaining[item.ProductId] -= item.Quantity
+        }
+    }
+    return noneRemaining(remaining)
+}
+
+func lastTransitionTo(order *pb.Order, to string) (time.Time, bool) {
+    for i := len(order.History) - 1; i >= 0; i-- {
+        if order.History[i].ToStatus == to {
+            at, err := time.Parse(time.RFC3339, order.History[i].ChangedAt)
+            return at, err == nil
+        }
+    }
+    return time.Time{}, false
+}
+
+func returnResponse(order *pb.Order, orderReturn *pb.OrderReturn) *pb.ReturnResponse {
+    return &pb.ReturnResponse{
+        OrderReturn: proto.Clone(orderReturn).(*pb.OrderReturn),
+        Order:       proto.Clone(order).(*pb.Order),
+    }
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+
+    pb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+// deliveredOrder has two lines of p1 at different prices and ships for 5.
+func deliveredOrder() *pb.Order {
+    order := &pb.Order{
+        Id:     "order_1",
+        UserId: "user_1",
+        Items: []*pb.OrderItem{
+            {ProductId: "p1", Quantity: 1, Price: 10},
+            {ProductId: "p1", Quantity: 1, Price: 20},
+            {ProductId: "p2", Quantity: 2, Price: 5},
+        },
+        SubtotalAmount: 40,
+        TotalAmount:    45,
+        Pricing:        &pb.PriceBreakdown{Shipping: 5},
+        Status:         "shipped",
+        Currency:       "USD",
+    }
+    transition(order, "delivered", "test", "delivered", time.Now())
+    return order
+}
+
+func TestReturnRefundAmountUsesLinePrice(t *testing.T) {
+    tests := []struct {
+        name   string
+        items  []*pb.ReturnItem
+        amount float32
+    }{
+        {name: "first line", items: []*pb.ReturnItem{{ProductId: "p1", Quantity: 1}}, amount: 10},
+        {name: "second line", items: []*pb.ReturnItem{{ProductId: "p1", Quantity: 1, LineIndex: 1}}, amount: 20},
+        {name: "both lines", items: []*pb.ReturnItem{{ProductId: "p1", Quantity: 1}, {ProductId: "p1", Quantity: 1, LineIndex: 1}}, amount: 30},
+        {name: "other product", items: []*pb.ReturnItem{{ProductId: "p2", Quantity: 2}}, amount: 10},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            order := deliveredOrder()
+            orderReturn := &pb.OrderReturn{Id: "order_1_return_1", Items: tt.items}
+            if got := returnRefundAmount(order, orderReturn); got != tt.amount {
+                t.Errorf("returnRefundAmount = %.2f, want %.2f", got, tt.amount)
+            }
+        })
+    }
+}
+
+// TestRequestReturnByLine returns the dearer of two lines of one product
+// and checks the quantities are tracked per line.
+func TestRequestReturnByLine(t *testing.T) {
+    s := newOrderService(fakeUserClient{}, nil, orderServiceConfig{returnWindow: time.Hour})
+    s.orders["order_1"] = deliveredOrder()
+    ctx := context.Background()
+
+    resp, err := s.RequestReturn(ctx, &pb.RequestReturnRequest{
+        OrderId: "order_1",
+        Items:   []*pb.ReturnItem{{ProductId: "p1", Quantity: 1, LineIndex: 1}},
+        Actor:   "user_1",
+    })
+    if err != nil {
+        t.Fatalf("RequestReturn: %v", err)
+    }
+
+    rejected := []struct {
+        name string
+        item *pb.ReturnItem
+    }{
+        {name: "line already returned", item: &pb.ReturnItem{ProductId: "p1", Quantity: 1, LineIndex: 1}},
+        {name: "more than the line has", item: &pb.ReturnItem{ProductId: "p1", Quantity: 2}},
+        {name: "no such line", item: &pb.ReturnItem{ProductId: "p1", Quantity: 1, LineIndex: 2}},
+    }
+    for _, tt := range rejected {
+        t.Run(tt.name, func(t *testing.T) {
+            _, err := s.RequestReturn(ctx, &pb.RequestReturnRequest{OrderId: "order_1", Items: []*pb.ReturnItem{tt.item}, Actor: "user_1"})
+            if status.Code(err) != codes.FailedPrecondition {
+                t.Fatalf("RequestReturn error = %v, want code %s", err, codes.FailedPrecondition)
+            }
+        })
+    }
+
+    returnID := resp.OrderReturn.Id
+    for _, step := range []struct{ from, to string }{{"requested", "approved"}, {"approved", "received"}, {"received", "refunding"}} {
+        resp, err = s.advanceReturn(&pb.ReturnActionRequest{OrderId: "order_1", ReturnId: returnID, Actor: "admin"}, step.from, step.to)
+        if err != nil {
+            t.Fatalf("advanceReturn to %s: %v", step.to, err)
+        }
+    }
+    if resp.OrderReturn.RefundAmount != 20 {
+        t.Errorf("refund amount = %.2f, want 20", resp.OrderReturn.RefundAmount)
+    }
+}
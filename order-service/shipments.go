@@ -0,0 +1,160 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "time"
+
+    pb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
+)
+
+func (s *orderService) CreateShipment(ctx context.Context, req *pb.CreateShipmentRequest) (*pb.ShipmentResponse, error) {
+    if req.Carrier == "" || req.TrackingNumber == "" {
+        return nil, status.Errorf(codes.InvalidArgument, "carrier and tracking_number are required")
+    }
+    if req.Actor == "" {
+        return nil, status.Errorf(codes.InvalidArgument, "actor is required")
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    stored, exists := s.orders[req.OrderId]
+    if !exists {
+        return nil, status.Errorf(codes.NotFound, "order not found")
+    }
+    if stored.Status != "confirmed" && stored.Status != "authorized" {
+        return nil, status.Errorf(codes.FailedPrecondition, "only paid or authorized orders can be shipped, order is %s", stored.Status)
+    }
+
+    remaining := unshippedQuantities(stored)
+    items := req.Items
+    if len(items) == 0 {
+        for _, item := range stored.Items {
+            if n := remaining[item.ProductId]; n > 0 {
+                items = append(items, &pb.ShipmentItem{ProductId: item.ProductId, Quantity: n})
+                remaining[item.ProductId] = 0
+            }
+        }
+        if len(items) == 0 {
+            return nil, status.Errorf(codes.FailedPrecondition, "all items have already shipped")
+        }
+    } else {
+        for _, item := range items {
+            if item.Quantity <= 0 {
+                return nil, status.Errorf(codes.InvalidArgument, "quantity for %s must be positive", item.ProductId)
+            }
+            if item.Quantity > remaining[item.ProductId] {
+                return nil, status.Errorf(codes.FailedPrecondition, "only %d of %s left to ship", remaining[item.ProductId], item.ProductId)
+            }
+            remaining[item.ProductId] -= item.Quantity
+        }
+    }
+
+    now := time.Now()
+    s.shipmentSeq++
+    shipment := &pb.Shipment{
+        Id:             fmt.Sprintf("shipment_%d", s.shipmentSeq),
+        OrderId:        stored.Id,
+        Carrier:        req.Carrier,
+        TrackingNumber: req.TrackingNumber,
+        ShippedAt:      now.Format(time.RFC3339),
+    }
+    for _, item := range items {
+        shipment.Items = append(shipment.Items, proto.Clone(item).(*pb.ShipmentItem))
+    }
+
+    order := proto.Clone(stored).(*pb.Order)
+    order.Shipments = append(order.Shipments, shipment)
+    order.Version++
+    if noneRemaining(remaining) {
+        transition(order, "shipped", req.Actor, fmt.Sprintf("all items shipped, last in %s", shipment.Id), now)
+        s.enqueueEvent(pb.OrderEventType_ORDER_SHIPPED, order)
+    }
+    s.orders[order.Id] = order
+
+    return &pb.ShipmentResponse{
+        Shipment: proto.Clone(shipment).(*pb.Shipment),
+        Order:    proto.Clone(order).(*pb.Order),
+    }, nil
+}
+
+func (s *orderService) MarkDelivered(ctx context.Context, req *pb.MarkDeliveredRequest) (*pb.ShipmentResponse, error) {
+    if req.Actor == "" {
+        return nil, status.Errorf(codes.InvalidArgument, "actor is required")
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    stored, exists := s.orders[req.OrderId]
+    if !exists {
+        return nil, status.Errorf(codes.NotFound, "order not found")
+    }
+
+    order := proto.Clone(stored).(*pb.Order)
+    var shipment *pb.Shipment
+    for _, candidate := range order.Shipments {
+        if candidate.Id == req.ShipmentId {
+            shipment = candidate
+        }
+    }
+    if shipment == nil {
+        return nil, status.Errorf(codes.NotFound, "shipment not found")
+    }
+    if shipment.DeliveredAt != "" {
+        return nil, status.Errorf(codes.FailedPrecondition, "shipment was already delivered at %s", shipment.DeliveredAt)
+    }
+
+    now := time.Now()
+    shipment.DeliveredAt = now.Format(time.RFC3339)
+    order.Version++
+
+    if order.Status == "shipped" && allDelivered(order.Shipments) {
+        transition(order, "delivered", req.Actor, fmt.Sprintf("all shipments delivered, last %s", shipment.Id), now)
+        s.enqueueEvent(pb.OrderEventType_ORDER_DELIVERED, order)
+    }
+    s.orders[order.Id] = order
+
+    return &pb.ShipmentResponse{
+        Shipment: proto.Clone(shipment).(*pb.Shipment),
+        Order:    proto.Clone(order).(*pb.Order),
+    }, nil
+}
+
+// unshippedQuantities returns, per product, how many units of the order are
+// not covered by a shipment yet.
+func unshippedQuantities(order *pb.Order) map[string]int32 {
+    remaining := make(map[string]int32)
+    for _, item := range order.Items {
+        remaining[item.ProductId] += item.Quantity
+    }
+    for _, shipment := range order.Shipments {
+        for _, item := range shipment.Items {
+            remaining[item.ProductId] -= item.Quantity
+        }
+    }
+    return remaining
+}
+
+// noneRemaining reports whether every per-product count has reached zero.
+func noneRemaining(remaining map[string]int32) bool {
+    for _, n := range remaining {
+        if n > 0 {
+            return false
+        }
+    }
+    return true
+}
+
+func allDelivered(shipments []*pb.Shipment) bool {
+    for _, shipment := range shipments {
+        if shipment.DeliveredAt == "" {
+            return false
+        }
+    }
+    return len(shipments) > 0
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "time"
+
+    orderPb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
+)
+
+func (s *paymentService) AuthorizePayment(ctx context.Context, req *paymentPb.AuthorizePaymentRequest) (*paymentPb.PaymentResponse, error) {
+    payment, existing, err := s.reserveCharge(ctx, chargeRequest{
+        OrderID:       req.OrderId,
+        UserID:        req.UserId,
+        Amount:        req.Amount,
+        PaymentMethod: req.PaymentMethod,
+        Currency:      req.Currency,
+        AllowPartial:  req.AllowPartial,
+    })
+    if err != nil {
+        return nil, err
+    }
+    if existing || payment.Status == paymentPb.PaymentStatus_REVIEW {
+        return &paymentPb.PaymentResponse{Payment: payment}, nil
+    }
+    defer s.releaseOrder(payment.OrderId)
+
+    payment, err = s.runAuthorization(ctx, payment)
+    if err != nil {
+        return nil, err
+    }
+
+    return &paymentPb.PaymentResponse{Payment: payment}, nil
+}
+
+// runAuthorization places a hold for a claimed payment and records it on
+// the order.
+func (s *paymentService) runAuthorization(ctx context.Context, payment *paymentPb.Payment) (*paymentPb.Payment, error) {
+    record := &orderPb.RecordPaymentRequest{Kind: orderPb.PaymentRecordKind_PAYMENT_AUTHORIZED}
+    err := s.runSaga(ctx, payment.Id, "authorize", []sagaStep{
+        s.authorizeStep(payment.Id, record),
+        s.recordOnOrderStep("record_authorization", record),
+    })
+    if err != nil {
+        s.failPayment(payment.Id, err)
+        return nil, gatewayStatus(err)
+    }
+
+    return s.snapshot(payment.Id), nil
+}
+
+func (s *paymentService) CapturePayment(ctx context.Context, req *paymentPb.CapturePaymentRequest) (*paymentPb.PaymentResponse, error) {
+    if req.Amount < 0 {
+        return nil, status.Errorf(codes.InvalidArgument, "amount must not be negative")
+    }
+
+    payment, err := s.claimPayment(req.PaymentId, paymentPb.PaymentStatus_AUTHORIZED, paymentPb.PaymentStatus_PARTIALLY_CAPTURED)
+    if err != nil {
+        return nil, err
+    }
+    defer s.releaseOrder(payment.OrderId)
+
+    amount := req.Amount
+    uncaptured := roundCents(payment.AuthorizedAmount - payment.CapturedAmount)
+    if amount == 0 {
+        amount = uncaptured
+    }
+    if amount > uncaptured+amountTolerance {
+        return nil, status.Errorf(codes.FailedPrecondition, "capture of %.2f exceeds the uncaptured %.2f", amount, uncaptured)
+    }
+
+    // The hold was recorded on the order, so the capture is taken out of it.
+    record := &orderPb.RecordPaymentRequest{FromAuthorization: true}
+    err = s.runSaga(ctx, payment.Id, "capture", []sagaStep{
+        s.captureStep(payment.Id, amount, record),
+        s.recordOnOrderStep("confirm_order", record),
+    })
+    if err != nil {
+        if s.captureReversed(payment.Id) {
+            s.releaseReversedCapture(ctx, record)
+        }
+        return nil, gatewayStatus(err)
+    }
+
+    return &paymentPb.PaymentResponse{Payment: s.snapshot(payment.Id)}, nil
+}
+
+// captureReversed reports whether the payment's last saga refunded its
+// capture.
+func (s *paymentService) captureReversed(paymentID string) bool {
+    sagas := s.snapshot(paymentID).Sagas
+    if len(sagas) == 0 {
+        return false
+    }
+    for _, step := range sagas[len(sagas)-1].Steps {
+        if step.Name == "capture" {
+            return step.Status == paymentPb.SagaStepStatus_STEP_COMPENSATED
+        }
+    }
+    return false
+}
+
+// releaseReversedCapture tells the order that a capture of its recorded
+// hold was refunded instead of confirmed, so that part of the hold is gone.
+// record is the capture's confirmation, filled in by captureStep.
+func (s *paymentService) releaseReversedCapture(ctx context.Context, record *orderPb.RecordPaymentRequest) {
+    release := proto.Clone(record).(*orderPb.RecordPaymentRequest)
+    release.Kind = orderPb.PaymentRecordKind_AUTHORIZATION_RELEASED
+    release.FromAuthorization = false
+    release.RecordId = "release:" + record.RecordId
+
+    _, err := s.attempt(context.WithoutCancel(ctx), true, func(ctx context.Context) error {
+        _, err := s.orderClient.RecordPayment(ctx, release)
+        return err
+    })
+    if err != nil {
+        log.Printf("payment %s: capture was refunded but the order still holds it: %v", record.PaymentId, err)
+    }
+}
+
+func (s *paymentService) VoidAuthorization(ctx context.Context, req *paymentPb.VoidAuthorizationRequest) (*paymentPb.PaymentResponse, error) {
+    payment, err := s.claimPayment(req.PaymentId, paymentPb.PaymentStatus_AUTHORIZED, paymentPb.PaymentStatus_PARTIALLY_CAPTURED)
+    if err != nil {
+        return nil, err
+    }
+    defer s.releaseOrder(payment.OrderId)
+
+    payment, err = s.releaseClaimed(ctx, payment, paymentPb.PaymentStatus_VOIDED)
+    if err != nil {
+        return nil, err
+    }
+
+    return &paymentPb.PaymentResponse{Payment: payment}, nil
+}
+
+// reserveCharge checks the payer owns the order, reserves the order for the
+// charge, validating it against the order (see reservePayment), and screens
+// it for fraud. A payment held for
+// review comes back in REVIEW with the order already released.
+func (s *paymentService) reserveCharge(ctx context.Context, req chargeRequest) (*paymentPb.Payment, bool, error) {
+    method, err := s.paymentMethod(req.PaymentMethod, req.UserID)
+    if err != nil {
+        return nil, false, err
+    }
+
+    orderResp, err := s.orderClient.GetOrder(ctx, &orderPb.GetOrderRequest{Id: req.OrderID})
+    if err != nil {
+        return nil, false, status.Errorf(codes.InvalidArgument, "order not found: %v", err)
+    }
+    if err := validatePayer(orderResp.Order, req); err != nil {
+        return nil, false, err
+    }
+
+    payment, existing, err := s.reservePayment(req, orderResp.Order, method.method)
+    if err != nil || existing {
+        return payment, existing, err
+    }
+
+    payment, err = s.screenPayment(ctx, payment, req.Capture)
+    if err != nil || payment.Status == paymentPb.PaymentStatus_REVIEW {
+        s.releaseOrder(req.OrderID)
+    }
+    return payment, false, err
+}
+
+// claimPayment takes the per-order lock for an existing payment in one of
+// the allowed statuses. The caller must call releaseOrder when done.
+func (s *paymentService) claimPayment(paymentID string, allowed ...paymentPb.PaymentStatus) (*paymentPb.Payment, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    payment, exists := s.payments[paymentID]
+    if !exists {
+        return nil, status.Errorf(codes.NotFound, "payment not found")
+    }
+
+    ok := false
+    for _, st := range allowed {
+        ok = ok || payment.Status == st
+    }
+    if !ok {
+        return nil, status.Errorf(codes.FailedPrecondition, "payment is %s", payment.Status)
+    }
+
+    if busy, inFlight := s.inFlight[payment.OrderId]; inFlight {
+        return nil, status.Errorf(codes.AlreadyExists, "payment %s for order %s is already in progress", busy, payment.OrderId)
+    }
+    s.inFlight[payment.OrderId] = payment.Id
+
+    return proto.Clone(payment).(*paymentPb.Payment), nil
+}
+
+// authorizeStep places a hold for a reserved payment and, when record is
+// not nil, fills it in for recording the hold on the order. Its
+// compensation voids the hold.
+func (s *paymentService) authorizeStep(paymentID string, record *orderPb.RecordPaymentRequest) sagaStep {
+    return sagaStep{
+        name: "authorize",
+        action: func(ctx context.Context) error {
+            payment := s.snapshot(paymentID)
+            method, err := s.paymentMethod(payment.PaymentMethod, payment.UserId)
+            if err != nil {
+                return err
+            }
+            authorizationID, err := s.gateway.Authorize(ctx, gatewayAuthorization{
+                PaymentID:     payment.Id,
+                PaymentMethod: payment.PaymentMethod,
+                Fingerprint:   method.fingerprint,
+                Amount:        payment.Amount,
+                Currency:      payment.Currency,
+            })
+            if err != nil {
+                return err
+            }
+
+            now := time.Now()
+            payment, err = s.updateJournaled(paymentID, func(p *paymentPb.Payment) error {
+                p.GatewayReference = authorizationID
+                p.Status = paymentPb.PaymentStatus_AUTHORIZED
+                p.AuthorizedAmount = p.Amount
+                p.AuthorizedAt = now.Format(time.RFC3339)
+                if s.config.authorizationTTL > 0 {
+                    p.AuthorizationExpiresAt = now.Add(s.config.authorizationTTL).Format(time.RFC3339)
+                }
+                return s.postAuthorization(p, p.AuthorizedAmount, authorizationID)
+            })
+            if err != nil {
+                // The hold was not recorded, so no compensation will void it.
+                if voidErr := s.gateway.Void(ctx, authorizationID); voidErr != nil {
+                    log.Printf("payment %s: failed to void unrecorded authorization %s: %v", paymentID, authorizationID, voidErr)
+                }
+                return err
+            }
+            if record != nil {
+                fillRecord(record, payment, payment.AuthorizedAmount, authorizationID)
+            }
+            return nil
+        },
+        compensate: func(ctx context.Context) error {
+            reference := s.snapshot(paymentID).GatewayReference
+            if err := s.gateway.Void(ctx, reference); err != nil {
+                return err
+            }
+            _, err := s.updateJournaled(paymentID, func(p *paymentPb.Payment) error {
+                return s.postRelease(p, roundCents(p.AuthorizedAmount-p.CapturedAmount), "void:"+reference)
+            })
+            return err
+        },
+    }
+}
+
+// captureStep captures amount of a claimed payment's hold and fills record
+// in for confirming the capture on the order. Its compensation refunds the
+// capture, which leaves the payment in the state of its remaining hold.
+func (s *paymentService) captureStep(paymentID string, amount float32, record *orderPb.RecordPaymentRequest) sagaStep {
+    return sagaStep{
+        name: "capture",
+        action: func(ctx context.Context) error {
+            captureID, err := s.gateway.Capture(ctx, s.snapshot(paymentID).GatewayReference, amount)
+            if err != nil {
+                return err
+            }
+
+            payment, err := s.updateJournaled(paymentID, func(p *paymentPb.Payment) error {
+                p.CapturedAmount = roundCents(p.CapturedAmount + amount)
+                if p.CapturedAmount >= p.AuthorizedAmount-amountTolerance {
+                    p.Status = paymentPb.PaymentStatus_CAPTURED
+                } else {
+                    p.Status = paymentPb.PaymentStatus_PARTIALLY_CAPTURED
+                }
+                return s.postCapture(p, amount, captureID)
+            })
+            if err != nil {
+                // The capture was not recorded, so no compensation will
+                // refund it.
+                if _, refundErr := s.gateway.Refund(ctx, s.snapshot(paymentID).GatewayReference, amount); refundErr != nil {
+                    log.Printf("payment %s: failed to refund unrecorded capture %s: %v", paymentID, captureID, refundErr)
+                }
+                return err
+            }
+            fillRecord(record, payment, amount, captureID)
+            return nil
+        },
+        compensate: func(ctx context.Context) error {
+            gatewayRef, err := s.gateway.Refund(ctx, s.snapshot(paymentID).GatewayReference, amount)
+            if err != nil {
+                return err
+            }
+
+            var refundID string
+            s.updatePayment(paymentID, func(p *paymentPb.Payment) {
+                s.refundSeq++
+                refundID = fmt.Sprintf("refund_%d", s.refundSeq)
+                p.Refunds = append(p.Refunds, &paymentPb.Refund{
+                    Id:           refundID,
+                    PaymentId:    p.Id,
+                    Amount:       amount,
+                    Reason:       "order confirmation failed",
+                    Status:       paymentPb.RefundStatus_REFUND_PENDING,
+                    CreatedAt:    time.Now().Format(time.RFC3339),
+                    Compensation: true,
+                })
+            })
+            _, _, err = s.settleRefund(paymentID, refundID, func(r *paymentPb.Refund) {
+                r.Status = paymentPb.RefundStatus_REFUND_SUCCEEDED
+                r.GatewayReference = gatewayRef
+            })
+            return err
+        },
+    }
+}
+
+// recordOnOrderStep sends record, filled in by an earlier step, to the
+// order service. RecordPayment is idempotent by record ID, so the step is
+// retried.
+func (s *paymentService) recordOnOrderStep(name string, record *orderPb.RecordPaymentRequest) sagaStep {
+    return sagaStep{
+        name:  name,
+        retry: true,
+        action: func(ctx context.Context) error {
+            _, err := s.orderClient.RecordPayment(ctx, record)
+            return err
+        },
+    }
+}
+
+// fillRecord completes an order payment record for payment. The gateway's
+// ID for the operation doubles as the record ID.
+func fillRecord(record *orderPb.RecordPaymentRequest, payment *paymentPb.Payment, amount float32, recordID string) {
+    record.OrderId = payment.OrderId
+    record.PaymentId = payment.Id
+    record.Amount = amount
+    record.Currency = payment.Currency
+    record.Actor = "payment-service"
+    record.RecordId = recordID
+}
+
+// releaseClaimed voids what is left of a claimed payment's hold. A payment
+// with captures becomes CAPTURED; otherwise it ends in final.
+func (s *paymentService) releaseClaimed(ctx context.Context, payment *paymentPb.Payment, final paymentPb.PaymentStatus) (*paymentPb.Payment, error) {
+    if err := s.gateway.Void(ctx, payment.GatewayReference); err != nil {
+        return nil, gatewayStatus(err)
+    }
+
+    released := roundCents(payment.AuthorizedAmount - payment.CapturedAmount)
+    payment, err := s.updateJournaled(payment.Id, func(p *paymentPb.Payment) error {
+        if p.CapturedAmount > 0 {
+            p.Status = paymentPb.PaymentStatus_CAPTURED
+        } else {
+            p.Status = final
+        }
+        return s.postRelease(p, released, "void:"+p.GatewayReference)
+    })
+    if err != nil {
+        return nil, err
+    }
+    if released <= 0 {
+        return payment, nil
+    }
+
+    record := &orderPb.RecordPaymentRequest{Kind: orderPb.PaymentRecordKind_AUTHORIZATION_RELEASED}
+    fillRecord(record, payment, released, "void:"+payment.GatewayReference)
+    _, err = s.attempt(ctx, true, func(ctx context.Context) error {
+        _, err := s.orderClient.RecordPayment(ctx, record)
+        return err
+    })
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "hold released but failed to update order: %v", err)
+    }
+
+    return payment, nil
+}
+
+// runAuthorizationSweeper expires holds past their deadline every interval
+// until ctx is cancelled.
+func (s *paymentService) runAuthorizationSweeper(ctx context.Context, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case now := <-ticker.C:
+            for _, paymentID := range s.expiredAuthorizations(now) {
+                payment, err := s.claimPayment(paymentID, paymentPb.PaymentStatus_AUTHORIZED, paymentPb.PaymentStatus_PARTIALLY_CAPTURED)
+                if err != nil {
+                    continue
+                }
+                if _, err := s.releaseClaimed(ctx, payment, paymentPb.PaymentStatus_EXPIRED); err != nil {
+                    log.Printf("failed to expire authorization of payment %s: %v", paymentID, err)
+                }
+                s.releaseOrder(payment.OrderId)
+            }
+        }
+    }
+}
+
+func (s *paymentService) expiredAuthorizations(now time.Time) []string {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    var expired []string
+    for id, payment := range s.payments {
+        if payment.Status != paymentPb.PaymentStatus_AUTHORIZED && payment.Status != paymentPb.PaymentStatus_PARTIALLY_CAPTURED {
+            continue
+        }
+        deadline, err := time.Parse(time.RFC3339, payment.AuthorizationExpiresAt)
+        if err == nil && !now.Before(deadline) {
+            expired = append(expired, id)
+        }
+    }
+    return expired
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "strings"
+    "time"
+
+    orderPb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
+)
+
+// maxEvidenceFiles and maxEvidenceFileBytes bound one evidence submission.
+const (
+    maxEvidenceFiles     = 10
+    maxEvidenceFileBytes = 1 << 20
+)
+
+// disputeRequest is what OpenDispute and the gateway's webhook both open a
+// dispute from. A zero EvidenceDueBy uses the configured evidence window.
+type disputeRequest struct {
+    PaymentID        string
+    Amount           float32
+    Reason           string
+    EvidenceDueBy    time.Time
+    GatewayReference string
+    Actor            string
+}
+
+func (s *paymentService) OpenDispute(ctx context.Context, req *paymentPb.OpenDisputeRequest) (*paymentPb.DisputeResponse, error) {
+    if req.Actor == "" {
+        return nil, status.Errorf(codes.InvalidArgument, "actor is required")
+    }
+    if req.Amount < 0 {
+        return nil, status.Errorf(codes.InvalidArgument, "dispute amount must be positive")
+    }
+
+    open := disputeRequest{
+        PaymentID:        req.PaymentId,
+        Amount:           req.Amount,
+        Reason:           req.Reason,
+        GatewayReference: req.GatewayReference,
+        Actor:            req.Actor,
+    }
+    if req.EvidenceDueBy != "" {
+        dueBy, err := time.Parse(time.RFC3339, req.EvidenceDueBy)
+        if err != nil {
+            return nil, status.Errorf(codes.InvalidArgument, "evidence_due_by must be an RFC 3339 time")
+        }
+        open.EvidenceDueBy = dueBy
+    }
+
+    payment, dispute, err := s.openDispute(open)
+    if err != nil {
+        return nil, err
+    }
+
+    return &paymentPb.DisputeResponse{Dispute: dispute, Payment: payment}, nil
+}
+
+// openDispute records a dispute and withholds its amount. A dispute the
+// gateway reported before is returned as it is.
+func (s *paymentService) openDispute(req disputeRequest) (*paymentPb.Payment, *paymentPb.Dispute, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    payment, exists := s.payments[req.PaymentID]
+    if !exists {
+        return nil, nil, status.Errorf(codes.NotFound, "payment not found")
+    }
+    if req.GatewayReference != "" {
+        for _, dispute := range payment.Disputes {
+            if dispute.GatewayReference == req.GatewayReference {
+                return proto.Clone(payment).(*paymentPb.Payment), proto.Clone(dispute).(*paymentPb.Dispute), nil
+            }
+        }
+    }
+
+    disputable := disputableAmount(payment)
+    if disputable <= amountTolerance {
+        return nil, nil, status.Errorf(codes.FailedPrecondition, "payment is %s with nothing left to dispute", payment.Status)
+    }
+    amount := req.Amount
+    if amount == 0 {
+        amount = disputable
+    }
+    if amount > disputable+amountTolerance {
+        return nil, nil, status.Errorf(codes.FailedPrecondition, "dispute of %.2f exceeds the disputable %.2f", amount, disputable)
+    }
+
+    now := time.Now()
+    dueBy := req.EvidenceDueBy
+    if dueBy.IsZero() {
+        dueBy = now.Add(s.config.disputeEvidenceWindow)
+    }
+
+    dispute := &paymentPb.Dispute{
+        Id:               fmt.Sprintf("dispute_%d", s.disputeSeq+1),
+        PaymentId:        payment.Id,
+        OrderId:          payment.OrderId,
+        Amount:           roundCents(amount),
+        Currency:         payment.Currency,
+        Reason:           req.Reason,
+        Status:           paymentPb.DisputeStatus_DISPUTE_OPEN,
+        EvidenceDueBy:    dueBy.Format(time.RFC3339),
+        GatewayReference: req.GatewayReference,
+        OpenedBy:         req.Actor,
+        CreatedAt:        now.Format(time.RFC3339),
+    }
+    if err := s.postDisputeHold(payment, dispute.Amount, dispute.Id); err != nil {
+        return nil, nil, err
+    }
+    s.disputeSeq++
+    payment.Disputes = append(payment.Disputes, dispute)
+    s.disputes[dispute.Id] = payment.Id
+
+    return proto.Clone(payment).(*paymentPb.Payment), proto.Clone(dispute).(*paymentPb.Dispute), nil
+}
+
+// SubmitDisputeEvidence forwards evidence for disputes the gateway reported
+// and keeps it with the dispute. The gateway is called without holding the
+// lock, so the dispute is checked again before the evidence is recorded.
+func (s *paymentService) SubmitDisputeEvidence(ctx context.Context, req *paymentPb.SubmitDisputeEvidenceRequest) (*paymentPb.DisputeResponse, error) {
+    if req.Actor == "" {
+        return nil, status.Errorf(codes.InvalidArgument, "actor is required")
+    }
+    if strings.TrimSpace(req.Text) == "" && len(req.Files) == 0 {
+        return nil, status.Errorf(codes.InvalidArgument, "evidence text or files are required")
+    }
+    if len(req.Files) > maxEvidenceFiles {
+        return nil, status.Errorf(codes.InvalidArgument, "at most %d evidence files may be submitted at once", maxEvidenceFiles)
+    }
+    for _, file := range req.Files {
+        if file.Name == "" {
+            return nil, status.Errorf(codes.InvalidArgument, "evidence files need a name")
+        }
+        if len(file.Content) > maxEvidenceFileBytes {
+            return nil, status.Errorf(codes.InvalidArgument, "evidence file %s exceeds %d bytes", file.Name, maxEvidenceFileBytes)
+        }
+    }
+
+    evidence := &paymentPb.DisputeEvidence{
+        Text:        req.Text,
+        Files:       req.Files,
+        SubmittedBy: req.Actor,
+        SubmittedAt: time.Now().Format(time.RFC3339),
+    }
+
+    _, dispute, err := s.updateDispute(req.DisputeId, func(p *paymentPb.Payment, d *paymentPb.Dispute) error {
+        return acceptsEvidence(d, time.Now())
+    })
+    if err != nil {
+        return nil, err
+    }
+    if dispute.GatewayReference != "" {
+        if err := s.gateway.SubmitDisputeEvidence(ctx, dispute.GatewayReference, evidence); err != nil {
+            return nil, gatewayStatus(err)
+        }
+    }
+
+    payment, dispute, err := s.updateDispute(req.DisputeId, func(p *paymentPb.Payment, d *paymentPb.Dispute) error {
+        if d.Status != paymentPb.DisputeStatus_DISPUTE_OPEN && d.Status != paymentPb.DisputeStatus_DISPUTE_EVIDENCE_SUBMITTED {
+            return status.Errorf(codes.Aborted, "dispute was %s while the evidence was submitted", d.Status)
+        }
+        d.Evidence = append(d.Evidence, evidence)
+        d.Status = paymentPb.DisputeStatus_DISPUTE_EVIDENCE_SUBMITTED
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return &paymentPb.DisputeResponse{Dispute: dispute, Payment: payment}, nil
+}
+
+// acceptsEvidence reports why evidence can no longer be submitted, if so.
+func acceptsEvidence(dispute *paymentPb.Dispute, now time.Time) error {
+    if dispute.Status != paymentPb.DisputeStatus_DISPUTE_OPEN && dispute.Status != paymentPb.DisputeStatus_DISPUTE_EVIDENCE_SUBMITTED {
+        return status.Errorf(codes.FailedPrecondition, "dispute is %s", dispute.Status)
+    }
+    dueBy, err := time.Parse(time.RFC3339, dispute.EvidenceDueBy)
+    if err == nil && now.After(dueBy) {
+        return status.Errorf(codes.FailedPrecondition, "evidence was due by %s", dispute.EvidenceDueBy)
+    }
+    return nil
+}
+
+// CloseDispute records the outcome of a dispute. A lost dispute is charged
+// back and recorded on the order.
+func (s *paymentService) CloseDispute(ctx context.Context, req *paymentPb.CloseDisputeRequest) (*paymentPb.DisputeResponse, error) {
+    if req.Actor == "" {
+        return nil, status.Errorf(codes.InvalidArgument, "actor is required")
+    }
+    if req.Outcome != paymentPb.DisputeStatus_DISPUTE_WON && req.Outcome != paymentPb.DisputeStatus_DISPUTE_LOST {
+        return nil, status.Errorf(codes.InvalidArgument, "outcome must be DISPUTE_WON or DISPUTE_LOST")
+    }
+
+    payment, dispute, err := s.closeDispute(req.DisputeId, req.Outcome, req.Actor, req.Note)
+    if err != nil {
+        return nil, err
+    }
+    if req.Outcome == paymentPb.DisputeStatus_DISPUTE_LOST {
+        payment, dispute = s.recordChargeback(ctx, payment, dispute)
+    }
+
+    return &paymentPb.DisputeResponse{Dispute: dispute, Payment: payment}, nil
+}
+
+// closeDispute closes a dispute and journals its outcome: a won dispute's
+// amount is paid back and a lost one is charged back.
+func (s *paymentService) closeDispute(disputeID string, outcome paymentPb.DisputeStatus, actor, note string) (*paymentPb.Payment, *paymentPb.Dispute, error) {
+    return s.updateDispute(disputeID, func(p *paymentPb.Payment, d *paymentPb.Dispute) error {
+        if d.Status != paymentPb.DisputeStatus_DISPUTE_OPEN && d.Status != paymentPb.DisputeStatus_DISPUTE_EVIDENCE_SUBMITTED {
+            return status.Errorf(codes.FailedPrecondition, "dispute is already %s", d.Status)
+        }
+
+        d.Status = outcome
+        d.ClosedBy = actor
+        d.ClosedAt = time.Now().Format(time.RFC3339)
+        d.CloseNote = note
+        if outcome == paymentPb.DisputeStatus_DISPUTE_WON {
+            return s.postDisputeRelease(p, d.Amount, d.Id)
+        }
+        p.ChargedBackAmount = roundCents(p.ChargedBackAmount + d.Amount)
+        return s.postChargeback(p, d.Amount, d.Id)
+    })
+}
+
+// recordChargeback tells the order about a lost dispute. RecordChargeback
+// is idempotent by dispute ID, so it is safe to retry; if it still fails
+// the dispute stays marked as not applied so reconciliation can catch up.
+func (s *paymentService) recordChargeback(ctx context.Context, payment *paymentPb.Payment, dispute *paymentPb.Dispute) (*paymentPb.Payment, *paymentPb.Dispute) {
+    notified := s.notifyOrder(ctx, payment, func(ctx context.Context) error {
+        _, err := s.orderClient.RecordChargeback(ctx, &orderPb.RecordChargebackRequest{
+            OrderId:   payment.OrderId,
+            PaymentId: payment.Id,
+            DisputeId: dispute.Id,
+            Amount:    dispute.Amount,
+            Currency:  payment.Currency,
+            Actor:     "payment-service",
+            Reason:    dispute.Reason,
+        })
+        return err
+    })
+    if !notified {
+        return payment, dispute
+    }
+
+    payment, dispute, _ = s.updateDispute(dispute.Id, func(p *paymentPb.Payment, d *paymentPb.Dispute) error {
+        d.OrderUpdated = true
+        return nil
+    })
+    return payment, dispute
+}
+
+// updateDispute applies update to a dispute and its payment under s.mu.
+// Nothing is returned or changed when update fails.
+func (s *paymentService) updateDispute(disputeID string, update func(*paymentPb.Payment, *paymentPb.Dispute) error) (*paymentPb.Payment, *paymentPb.Dispute, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    stored, exists := s.payments[s.disputes[disputeID]]
+    if !exists {
+        return nil, nil, status.Errorf(codes.NotFound, "dispute not found")
+    }
+    payment := proto.Clone(stored).(*paymentPb.Payment)
+    for _, dispute := range payment.Disputes {
+        if dispute.Id != disputeID {
+            continue
+        }
+        mark := len(s.journal)
+        if err := update(payment, dispute); err != nil {
+            s.dropEntries(mark)
+            return nil, nil, err
+        }
+        s.payments[payment.Id] = payment
+        return proto.Clone(payment).(*paymentPb.Payment), proto.Clone(dispute).(*paymentPb.Dispute), nil
+    }
+    return nil, nil, status.Errorf(codes.NotFound, "dispute not found")
+}
+
+// disputedAmount is what open and lost disputes have taken from a payment.
+func disputedAmount(payment *paymentPb.Payment) float32 {
+    var disputed float32
+    for _, dispute := range payment.Disputes {
+        if dispute.Status != paymentPb.DisputeStatus_DISPUTE_WON {
+            disputed += dispute.Amount
+        }
+    }
+    return disputed
+}
+
+// disputableAmount is what was captured and neither refunded, being
+// refunded nor disputed already.
+func disputableAmount(payment *paymentPb.Payment) float32 {
+    return roundCents(payment.CapturedAmount - payment.RefundedAmount - pendingRefunds(payment) - disputedAmount(payment))
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "time"
+
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+    orderPb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    userPb "github.com/AleksKislov/grpc_microservices_test/proto/user"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+// fraudRules score a payment before it is charged. Each enabled rule that
+// fires adds its score; a total of ReviewScore puts the payment in REVIEW
+// and DeclineScore declines it. A nil rule is disabled. Paying for another
+// user's order is not scored: validatePayer refuses it before screening.
+type fraudRules struct {
+    ReviewScore  int32           `json:"review_score"`
+    DeclineScore int32           `json:"decline_score"`
+    Velocity     *velocityRule   `json:"velocity"`
+    Amount       *amountRule     `json:"amount"`
+    NewAccount   *newAccountRule `json:"new_account"`
+    Declines     *declinesRule   `json:"declines"`
+}
+
+// velocityRule fires when a user or a card makes too many payments within
+// Window. A zero maximum disables that side.
+type velocityRule struct {
+    Window     duration `json:"window"`
+    MaxPerUser int      `json:"max_per_user"`
+    MaxPerCard int      `json:"max_per_card"`
+    Score      int32    `json:"score"`
+}
+
+type amountRule struct {
+    Threshold float32 `json:"threshold"`
+    Score     int32   `json:"score"`
+}
+
+// newAccountRule fires for accounts younger than MaxAge paying at least
+// MinAmount.
+type newAccountRule struct {
+    MaxAge    duration `json:"max_age"`
+    MinAmount float32  `json:"min_amount"`
+    Score     int32    `json:"score"`
+}
+
+// declinesRule fires when a user or a card was declined more than Max times
+// within Window.
+type declinesRule struct {
+    Window duration `json:"window"`
+    Max    int      `json:"max"`
+    Score  int32    `json:"score"`
+}
+
+// duration reads a time.Duration from a string such as "10m".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+    var value string
+    if err := json.Unmarshal(data, &value); err != nil {
+        return err
+    }
+    parsed, err := time.ParseDuration(value)
+    if err != nil {
+        return err
+    }
+    *d = duration(parsed)
+    return nil
+}
+
+// defaultFraudRules apply when no rules file is configured: no rule is
+// enabled, so only the checks made before screening apply.
+func defaultFraudRules() *fraudRules {
+    return &fraudRules{
+        ReviewScore:  50,
+        DeclineScore: 100,
+    }
+}
+
+func loadFraudRules(path string) (*fraudRules, error) {
+    if path == "" {
+        return defaultFraudRules(), nil
+    }
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var rules fraudRules
+    if err := json.Unmarshal(data, &rules); err != nil {
+        return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+    }
+    if rules.ReviewScore <= 0 || rules.DeclineScore < rules.ReviewScore {
+        return nil, fmt.Errorf("%s: need 0 < review_score <= decline_score", path)
+    }
+
+    return &rules, nil
+}
+
+// runFraudRulesReloader reloads the rules file whenever it changes, checking
+// every interval until ctx is cancelled. A file that fails to load is
+// reported and the previous rules stay in force.
+func (s *paymentService) runFraudRulesReloader(ctx context.Context, path string, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    var loaded time.Time
+    if info, err := os.Stat(path); err == nil {
+        loaded = info.ModTime()
+    }
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            info, err := os.Stat(path)
+            if err != nil || info.ModTime().Equal(loaded) {
+                continue
+            }
+            loaded = info.ModTime()
+
+            rules, err := loadFraudRules(path)
+            if err != nil {
+                log.Printf("failed to reload fraud rules, keeping the previous ones: %v", err)
+                continue
+            }
+            s.fraudRules.Store(rules)
+            log.Printf("reloaded fraud rules from %s", path)
+        }
+    }
+}
+
+// screenPayment scores a reserved payment and records the assessment on it.
+// A declined payment is failed and an error returned; a payment that needs
+// review is returned in REVIEW.
+func (s *paymentService) screenPayment(ctx context.Context, payment *paymentPb.Payment, captureOnApproval bool) (*paymentPb.Payment, error) {
+    assessment := s.assessFraud(ctx, payment, time.Now())
+
+    payment = s.updatePayment(payment.Id, func(p *paymentPb.Payment) {
+        p.Fraud = assessment
+        p.CaptureOnApproval = captureOnApproval
+        if assessment.Decision == paymentPb.FraudDecision_FRAUD_REVIEW {
+            p.Status = paymentPb.PaymentStatus_REVIEW
+        }
+    })
+
+    if assessment.Decision == paymentPb.FraudDecision_FRAUD_DECLINE {
+        err := &declineError{Code: "fraud_suspected", Reason: "failed fraud screening"}
+        s.failPayment(payment.Id, err)
+        return nil, gatewayStatus(err)
+    }
+    return payment, nil
+}
+
+func (s *paymentService) assessFraud(ctx context.Context, payment *paymentPb.Payment, now time.Time) *paymentPb.FraudAssessment {
+    rules := s.fraudRules.Load()
+    assessment := &paymentPb.FraudAssessment{AssessedAt: now.Format(time.RFC3339)}
+    fire := func(rule string, score int32, detail string, args ...any) {
+        assessment.Score += score
+        assessment.Signals = append(assessment.Signals, &paymentPb.FraudSignal{
+            Rule:   rule,
+            Score:  score,
+            Detail: fmt.Sprintf(detail, args...),
+        })
+    }
+
+    if rule := rules.Amount; rule != nil && payment.Amount >= rule.Threshold {
+        fire("amount", rule.Score, "amount %.2f reaches %.2f", payment.Amount, rule.Threshold)
+    }
+    if rule := rules.NewAccount; rule != nil && payment.Amount >= rule.MinAmount {
+        if age, ok := s.accountAge(ctx, payment.UserId, now); ok && age < time.Duration(rule.MaxAge) {
+            fire("new_account", rule.Score, "account is %s old", age.Round(time.Minute))
+        }
+    }
+    if rule := rules.Velocity; rule != nil {
+        byUser, byCard := s.recentPayments(payment, now.Add(-time.Duration(rule.Window)), false)
+        switch {
+        case rule.MaxPerUser > 0 && byUser > rule.MaxPerUser:
+            fire("velocity", rule.Score, "%d payments by the user within %s", byUser, time.Duration(rule.Window))
+        case rule.MaxPerCard > 0 && byCard > rule.MaxPerCard:
+            fire("velocity", rule.Score, "%d payments with the card within %s", byCard, time.Duration(rule.Window))
+        }
+    }
+    if rule := rules.Declines; rule != nil {
+        byUser, byCard := s.recentPayments(payment, now.Add(-time.Duration(rule.Window)), true)
+        if declines := max(byUser, byCard); declines > rule.Max {
+            fire("declines", rule.Score, "%d declines within %s", declines, time.Duration(rule.Window))
+        }
+    }
+
+    switch {
+    case assessment.Score >= rules.DeclineScore:
+        assessment.Decision = paymentPb.FraudDecision_FRAUD_DECLINE
+    case assessment.Score >= rules.ReviewScore:
+        assessment.Decision = paymentPb.FraudDecision_FRAUD_REVIEW
+    default:
+        assessment.Decision = paymentPb.FraudDecision_FRAUD_APPROVE
+    }
+    return assessment
+}
+
+// accountAge asks the user service how old the payer's account is. ok is
+// false when that is unknown, in which case the rule does not fire.
+func (s *paymentService) accountAge(ctx context.Context, userID string, now time.Time) (age time.Duration, ok bool) {
+    if s.userClient == nil {
+        return 0, false
+    }
+    resp, err := s.userClient.GetUser(ctx, &userPb.GetUserRequest{Id: userID})
+    if err != nil {
+        log.Printf("fraud screening could not look up user %s: %v", userID, err)
+        return 0, false
+    }
+    createdAt, err := time.Parse(time.RFC3339, resp.User.CreatedAt)
+    if err != nil {
+        return 0, false
+    }
+    return now.Sub(createdAt), true
+}
+
+// recentPayments counts payments created since by the same user and with
+// the same card as payment, itself included. With declined set, only
+// declined payments are counted and payment itself is not.
+func (s *paymentService) recentPayments(payment *paymentPb.Payment, since time.Time, declined bool) (byUser, byCard int) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    fingerprint := s.methodFingerprint(payment.PaymentMethod)
+    for _, id := range s.paymentIDs {
+        other := s.payments[id]
+        if declined && other.Status != paymentPb.PaymentStatus_DECLINED {
+            continue
+        }
+        createdAt, err := time.Parse(time.RFC3339, other.CreatedAt)
+        if err != nil || createdAt.Before(since) {
+            continue
+        }
+        if other.UserId == payment.UserId {
+            byUser++
+        }
+        if fingerprint != "" && s.methodFingerprint(other.PaymentMethod) == fingerprint {
+            byCard++
+        }
+    }
+    return byUser, byCard
+}
+
+// methodFingerprint must be called with s.mu held.
+func (s *paymentService) methodFingerprint(token string) string {
+    if stored, exists := s.methods[token]; exists {
+        return stored.fingerprint
+    }
+    return ""
+}
+
+func (s *paymentService) ApprovePayment(ctx context.Context, req *paymentPb.ReviewPaymentRequest) (*paymentPb.PaymentResponse, error) {
+    if req.Actor == "" {
+        return nil, status.Errorf(codes.InvalidArgument, "actor is required")
+    }
+
+    payment, err := s.claimPayment(req.PaymentId, paymentPb.PaymentStatus_REVIEW)
+    if err != nil {
+        return nil, err
+    }
+    defer s.releaseOrder(payment.OrderId)
+
+    // The order may have been paid, cancelled or changed while the payment
+    // waited for review.
+    orderResp, err := s.orderClient.GetOrder(ctx, &orderPb.GetOrderRequest{Id: payment.OrderId})
+    if err != nil {
+        return nil, status.Errorf(codes.Unavailable, "failed to load order: %v", err)
+    }
+    if err := validatePaymentForOrder(orderResp.Order, chargeRequest{
+        OrderID:      payment.OrderId,
+        UserID:       payment.UserId,
+        Amount:       payment.Amount,
+        Currency:     payment.Currency,
+        AllowPartial: true,
+    }); err != nil {
+        s.decideReview(payment.Id, req, paymentPb.PaymentStatus_FAILED, err.Error())
+        return nil, err
+    }
+
+    payment = s.decideReview(payment.Id, req, paymentPb.PaymentStatus_PROCESSING, "")
+    if payment.CaptureOnApproval {
+        payment, err = s.runCheckout(ctx, payment)
+    } else {
+        payment, err = s.runAuthorization(ctx, payment)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    return &paymentPb.PaymentResponse{Payment: payment}, nil
+}
+
+func (s *paymentService) RejectPayment(ctx context.Context, req *paymentPb.ReviewPaymentRequest) (*paymentPb.PaymentResponse, error) {
+    if req.Actor == "" {
+        return nil, status.Errorf(codes.InvalidArgument, "actor is required")
+    }
+
+    payment, err := s.claimPayment(req.PaymentId, paymentPb.PaymentStatus_REVIEW)
+    if err != nil {
+        return nil, err
+    }
+    defer s.releaseOrder(payment.OrderId)
+
+    payment = s.decideReview(payment.Id, req, paymentPb.PaymentStatus_DECLINED, "rejected in fraud review")
+    return &paymentPb.PaymentResponse{Payment: payment}, nil
+}
+
+// decideReview records a review decision and moves the payment to next.
+func (s *paymentService) decideReview(paymentID string, req *paymentPb.ReviewPaymentRequest, next paymentPb.PaymentStatus, failure string) *paymentPb.Payment {
+    return s.updatePayment(paymentID, func(p *paymentPb.Payment) {
+        p.Status = next
+        p.FailureReason = failure
+        p.Fraud.ReviewedBy = req.Actor
+        p.Fraud.ReviewedAt = time.Now().Format(time.RFC3339)
+        p.Fraud.ReviewNote = req.Note
+    })
+}
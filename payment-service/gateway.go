@@ -0,0 +1,71 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+// Gateway is the payment service provider that actually moves money.
+// Authorize places a hold, Capture takes up to the held amount, Void
+// releases a hold that was not captured, and Refund returns captured money.
+// SubmitDisputeEvidence answers a dispute the gateway reported.
+type Gateway interface {
+    Authorize(ctx context.Context, req gatewayAuthorization) (authorizationID string, err error)
+    Capture(ctx context.Context, authorizationID string, amount float32) (captureID string, err error)
+    Void(ctx context.Context, authorizationID string) error
+    Refund(ctx context.Context, authorizationID string, amount float32) (refundID string, err error)
+    SubmitDisputeEvidence(ctx context.Context, disputeID string, evidence *paymentPb.DisputeEvidence) error
+}
+
+type gatewayAuthorization struct {
+    PaymentID string
+    // PaymentMethod is the payment method token and Fingerprint identifies
+    // the card or account behind it.
+    PaymentMethod string
+    Fingerprint   string
+    Amount        float32
+    Currency      string
+}
+
+var (
+    // errGatewayTimeout means the gateway did not answer in time; the
+    // operation may or may not have happened.
+    errGatewayTimeout = errors.New("payment gateway timed out")
+    // errGatewayUnavailable means the gateway failed without doing anything.
+    errGatewayUnavailable = errors.New("payment gateway unavailable")
+)
+
+// declineError is returned when the issuer refuses a card.
+type declineError struct {
+    Code   string
+    Reason string
+}
+
+func (e *declineError) Error() string {
+    return fmt.Sprintf("card declined: %s (%s)", e.Reason, e.Code)
+}
+
+// gatewayStatus converts a gateway error into a gRPC status. Errors that
+// already are statuses, such as those from the order service, pass through.
+func gatewayStatus(err error) error {
+    if _, ok := status.FromError(err); ok {
+        return err
+    }
+
+    var decline *declineError
+    switch {
+    case errors.As(err, &decline):
+        return status.Errorf(codes.FailedPrecondition, "%v", decline)
+    case errors.Is(err, errGatewayTimeout), errors.Is(err, context.DeadlineExceeded):
+        return status.Errorf(codes.DeadlineExceeded, "%v", err)
+    case errors.Is(err, errGatewayUnavailable):
+        return status.Errorf(codes.Unavailable, "%v", err)
+    default:
+        return status.Errorf(codes.Internal, "payment gateway error: %v", err)
+    }
+}
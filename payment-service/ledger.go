@@ -0,0 +1,250 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "math"
+    "sort"
+    "strings"
+    "time"
+
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
+)
+
+// feeSchedule is what the gateway charges per capture.
+type feeSchedule struct {
+    rate       float64
+    fixedCents int64
+}
+
+// posting is one line of an entry being built: positive amounts debit the
+// account, negative ones credit it.
+type posting struct {
+    account paymentPb.LedgerAccount
+    cents   int64
+}
+
+type accountKey struct {
+    account  paymentPb.LedgerAccount
+    currency string
+}
+
+// postEntry appends a journal entry for payment. It must be called with
+// s.mu held, together with the payment change it journals. An entry whose
+// postings do not sum to zero is refused with an error, and the change it
+// belongs to must be refused too; updateJournaled does that.
+func (s *paymentService) postEntry(payment *paymentPb.Payment, entryType paymentPb.JournalEntryType, reference string, postings ...posting) error {
+    var sum int64
+    for _, p := range postings {
+        sum += p.cents
+    }
+    if sum != 0 {
+        return status.Errorf(codes.Internal, "unbalanced %s entry for payment %s: off by %d cents", entryType, payment.Id, sum)
+    }
+
+    s.journalSeq++
+    entry := &paymentPb.JournalEntry{
+        Id:        fmt.Sprintf("je_%d", s.journalSeq),
+        PaymentId: payment.Id,
+        OrderId:   payment.OrderId,
+        Type:      entryType,
+        Currency:  payment.Currency,
+        Reference: reference,
+        CreatedAt: time.Now().Format(time.RFC3339),
+    }
+    for _, p := range postings {
+        if p.cents == 0 {
+            continue
+        }
+        line := &paymentPb.JournalLine{Account: p.account}
+        if p.cents > 0 {
+            line.DebitCents = p.cents
+        } else {
+            line.CreditCents = -p.cents
+        }
+        entry.Lines = append(entry.Lines, line)
+    }
+    if len(entry.Lines) == 0 {
+        return nil
+    }
+
+    s.journal = append(s.journal, entry)
+    s.journalByPayment[payment.Id] = append(s.journalByPayment[payment.Id], len(s.journal)-1)
+    return nil
+}
+
+// dropEntries removes the entries posted after the journal had mark
+// entries, when the change that posted them is refused. It must be called
+// with s.mu held.
+func (s *paymentService) dropEntries(mark int) {
+    for _, entry := range s.journal[mark:] {
+        indexes := s.journalByPayment[entry.PaymentId]
+        s.journalByPayment[entry.PaymentId] = indexes[:len(indexes)-1]
+    }
+    s.journal = s.journal[:mark]
+}
+
+// postAuthorization records a hold: the customer owes the amount, offset
+// by the hold until it is captured or released.
+func (s *paymentService) postAuthorization(payment *paymentPb.Payment, amount float32, reference string) error {
+    cents := toCents(amount)
+    return s.postEntry(payment, paymentPb.JournalEntryType_AUTHORIZATION, reference,
+        posting{paymentPb.LedgerAccount_CUSTOMER_RECEIVABLE, cents},
+        posting{paymentPb.LedgerAccount_AUTHORIZATION_HOLDS, -cents},
+    )
+}
+
+// postCapture records captured money moving into gateway clearing as
+// revenue, and the gateway's fee for it.
+func (s *paymentService) postCapture(payment *paymentPb.Payment, amount float32, reference string) error {
+    cents := toCents(amount)
+    err := s.postEntry(payment, paymentPb.JournalEntryType_CAPTURE, reference,
+        posting{paymentPb.LedgerAccount_AUTHORIZATION_HOLDS, cents},
+        posting{paymentPb.LedgerAccount_MERCHANT_REVENUE, -cents},
+        posting{paymentPb.LedgerAccount_GATEWAY_CLEARING, cents},
+        posting{paymentPb.LedgerAccount_CUSTOMER_RECEIVABLE, -cents},
+    )
+    if err != nil {
+        return err
+    }
+
+    fee := int64(math.Round(float64(cents)*s.config.fees.rate)) + s.config.fees.fixedCents
+    return s.postEntry(payment, paymentPb.JournalEntryType_FEE, reference,
+        posting{paymentPb.LedgerAccount_GATEWAY_FEES, fee},
+        posting{paymentPb.LedgerAccount_GATEWAY_CLEARING, -fee},
+    )
+}
+
+// postRelease records the uncaptured part of a hold being dropped.
+func (s *paymentService) postRelease(payment *paymentPb.Payment, amount float32, reference string) error {
+    cents := toCents(amount)
+    return s.postEntry(payment, paymentPb.JournalEntryType_RELEASE, reference,
+        posting{paymentPb.LedgerAccount_AUTHORIZATION_HOLDS, cents},
+        posting{paymentPb.LedgerAccount_CUSTOMER_RECEIVABLE, -cents},
+    )
+}
+
+// postRefund records captured money going back to the customer. Gateway
+// fees are not returned on refunds.
+func (s *paymentService) postRefund(payment *paymentPb.Payment, amount float32, reference string) error {
+    cents := toCents(amount)
+    return s.postEntry(payment, paymentPb.JournalEntryType_REFUND, reference,
+        posting{paymentPb.LedgerAccount_MERCHANT_REVENUE, cents},
+        posting{paymentPb.LedgerAccount_GATEWAY_CLEARING, -cents},
+    )
+}
+
+// postDisputeHold records the gateway withholding a disputed amount.
+func (s *paymentService) postDisputeHold(payment *paymentPb.Payment, amount float32, reference string) error {
+    cents := toCents(amount)
+    return s.postEntry(payment, paymentPb.JournalEntryType_DISPUTE, reference,
+        posting{paymentPb.LedgerAccount_DISPUTE_RESERVE, cents},
+        posting{paymentPb.LedgerAccount_GATEWAY_CLEARING, -cents},
+    )
+}
+
+// postDisputeRelease records a won dispute's amount being paid back.
+func (s *paymentService) postDisputeRelease(payment *paymentPb.Payment, amount float32, reference string) error {
+    cents := toCents(amount)
+    return s.postEntry(payment, paymentPb.JournalEntryType_DISPUTE, reference,
+        posting{paymentPb.LedgerAccount_GATEWAY_CLEARING, cents},
+        posting{paymentPb.LedgerAccount_DISPUTE_RESERVE, -cents},
+    )
+}
+
+// postChargeback records a lost dispute: the withheld amount is gone and
+// no longer revenue. Like refunds, chargebacks do not return fees.
+func (s *paymentService) postChargeback(payment *paymentPb.Payment, amount float32, reference string) error {
+    cents := toCents(amount)
+    return s.postEntry(payment, paymentPb.JournalEntryType_CHARGEBACK, reference,
+        posting{paymentPb.LedgerAccount_MERCHANT_REVENUE, cents},
+        posting{paymentPb.LedgerAccount_DISPUTE_RESERVE, -cents},
+    )
+}
+
+func (s *paymentService) GetAccountBalances(ctx context.Context, req *paymentPb.GetAccountBalancesRequest) (*paymentPb.GetAccountBalancesResponse, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    balances := make(map[accountKey]*paymentPb.AccountBalance)
+    for _, entry := range s.journal {
+        for _, line := range entry.Lines {
+            key := accountKey{line.Account, entry.Currency}
+            balance, exists := balances[key]
+            if !exists {
+                balance = &paymentPb.AccountBalance{Account: line.Account, Currency: entry.Currency}
+                balances[key] = balance
+            }
+            balance.DebitCents += line.DebitCents
+            balance.CreditCents += line.CreditCents
+            balance.BalanceCents += line.DebitCents - line.CreditCents
+        }
+    }
+
+    resp := &paymentPb.GetAccountBalancesResponse{Balanced: s.ledgerBalanced(balances)}
+    for key, balance := range balances {
+        if req.Account != paymentPb.LedgerAccount_LEDGER_ACCOUNT_UNSPECIFIED && key.account != req.Account {
+            continue
+        }
+        if req.Currency != "" && !strings.EqualFold(key.currency, req.Currency) {
+            continue
+        }
+        resp.Balances = append(resp.Balances, balance)
+    }
+    sort.Slice(resp.Balances, func(i, j int) bool {
+        a, b := resp.Balances[i], resp.Balances[j]
+        if a.Currency != b.Currency {
+            return a.Currency < b.Currency
+        }
+        return a.Account < b.Account
+    })
+
+    return resp, nil
+}
+
+// ledgerBalanced checks that every entry sums to zero and that the balances
+// of each currency do too. It must be called with s.mu held.
+func (s *paymentService) ledgerBalanced(balances map[accountKey]*paymentPb.AccountBalance) bool {
+    for _, entry := range s.journal {
+        var sum int64
+        for _, line := range entry.Lines {
+            sum += line.DebitCents - line.CreditCents
+        }
+        if sum != 0 {
+            return false
+        }
+    }
+
+    totals := make(map[string]int64)
+    for key, balance := range balances {
+        totals[key.currency] += balance.BalanceCents
+    }
+    for _, total := range totals {
+        if total != 0 {
+            return false
+        }
+    }
+    return true
+}
+
+func (s *paymentService) ListJournalEntries(ctx context.Context, req *paymentPb.ListJournalEntriesRequest) (*paymentPb.ListJournalEntriesResponse, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    if _, exists := s.payments[req.PaymentId]; !exists {
+        return nil, status.Errorf(codes.NotFound, "payment not found")
+    }
+
+    resp := &paymentPb.ListJournalEntriesResponse{}
+    for _, i := range s.journalByPayment[req.PaymentId] {
+        resp.Entries = append(resp.Entries, proto.Clone(s.journal[i]).(*paymentPb.JournalEntry))
+    }
+    return resp, nil
+}
+
+func toCents(amount float32) int64 {
+    return int64(math.Round(float64(amount) * 100))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+    "context"
+    "testing"
+
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+// TestUnbalancedEntryIsRefused posts a balanced entry followed by an
+// unbalanced one in a single change. The change must fail with Internal and
+// leave the payment and the journal untouched, without taking the service
+// down.
+func TestUnbalancedEntryIsRefused(t *testing.T) {
+    s := newPaymentService(nil, nil, nil, paymentServiceConfig{})
+    s.payments["pay_1"] = &paymentPb.Payment{Id: "pay_1", OrderId: "order_1", Currency: "USD", Amount: 10, Status: paymentPb.PaymentStatus_PROCESSING}
+    s.paymentIDs = append(s.paymentIDs, "pay_1")
+
+    _, err := s.updateJournaled("pay_1", func(p *paymentPb.Payment) error {
+        p.Status = paymentPb.PaymentStatus_AUTHORIZED
+        p.AuthorizedAmount = 10
+        if err := s.postAuthorization(p, 10, "auth_1"); err != nil {
+            return err
+        }
+        return s.postEntry(p, paymentPb.JournalEntryType_CAPTURE, "cap_1",
+            posting{paymentPb.LedgerAccount_AUTHORIZATION_HOLDS, 1000},
+            posting{paymentPb.LedgerAccount_MERCHANT_REVENUE, -999},
+        )
+    })
+    if status.Code(err) != codes.Internal {
+        t.Fatalf("updateJournaled error = %v, want code %s", err, codes.Internal)
+    }
+
+    payment := s.snapshot("pay_1")
+    if payment.Status != paymentPb.PaymentStatus_PROCESSING || payment.AuthorizedAmount != 0 {
+        t.Errorf("payment changed to %s with %.2f authorized, want it untouched", payment.Status, payment.AuthorizedAmount)
+    }
+    if len(s.journal) != 0 || len(s.journalByPayment["pay_1"]) != 0 {
+        t.Errorf("journal has %d entries, %d for pay_1, want none", len(s.journal), len(s.journalByPayment["pay_1"]))
+    }
+
+    // The service keeps serving, and a balanced change still goes through.
+    if _, err := s.updateJournaled("pay_1", func(p *paymentPb.Payment) error {
+        p.Status = paymentPb.PaymentStatus_AUTHORIZED
+        return s.postAuthorization(p, 10, "auth_1")
+    }); err != nil {
+        t.Fatalf("balanced updateJournaled: %v", err)
+    }
+    balances, err := s.GetAccountBalances(context.Background(), &paymentPb.GetAccountBalancesRequest{})
+    if err != nil {
+        t.Fatalf("GetAccountBalances: %v", err)
+    }
+    if len(balances.Balances) == 0 || !balances.Balanced {
+        t.Errorf("balances = %v, balanced = %v, want the authorization balanced", balances.Balances, balances.Balanced)
+    }
+}
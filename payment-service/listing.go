@@ -0,0 +1,109 @@
+package main
+
+import (
+    "context"
+    "time"
+
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
+)
+
+const (
+    defaultListLimit = 20
+    maxListLimit     = 100
+)
+
+type paymentFilter struct {
+    orderID       string
+    userID        string
+    status        paymentPb.PaymentStatus
+    createdAfter  time.Time
+    createdBefore time.Time
+}
+
+func newPaymentFilter(req *paymentPb.ListPaymentsRequest) (paymentFilter, error) {
+    filter := paymentFilter{orderID: req.OrderId, userID: req.UserId, status: req.Status}
+
+    var err error
+    if req.CreatedAfter != "" {
+        if filter.createdAfter, err = time.Parse(time.RFC3339, req.CreatedAfter); err != nil {
+            return filter, status.Errorf(codes.InvalidArgument, "created_after must be RFC 3339: %v", err)
+        }
+    }
+    if req.CreatedBefore != "" {
+        if filter.createdBefore, err = time.Parse(time.RFC3339, req.CreatedBefore); err != nil {
+            return filter, status.Errorf(codes.InvalidArgument, "created_before must be RFC 3339: %v", err)
+        }
+    }
+
+    return filter, nil
+}
+
+func (f paymentFilter) matches(payment *paymentPb.Payment) bool {
+    if f.orderID != "" && payment.OrderId != f.orderID {
+        return false
+    }
+    if f.userID != "" && payment.UserId != f.userID {
+        return false
+    }
+    if f.status != paymentPb.PaymentStatus_PAYMENT_STATUS_UNSPECIFIED && payment.Status != f.status {
+        return false
+    }
+    if f.createdAfter.IsZero() && f.createdBefore.IsZero() {
+        return true
+    }
+
+    createdAt, err := time.Parse(time.RFC3339, payment.CreatedAt)
+    if err != nil {
+        return false
+    }
+    if !f.createdAfter.IsZero() && createdAt.Before(f.createdAfter) {
+        return false
+    }
+    if !f.createdBefore.IsZero() && createdAt.After(f.createdBefore) {
+        return false
+    }
+    return true
+}
+
+func (s *paymentService) ListPayments(ctx context.Context, req *paymentPb.ListPaymentsRequest) (*paymentPb.ListPaymentsResponse, error) {
+    if req.Page < 0 || req.Limit < 0 {
+        return nil, status.Errorf(codes.InvalidArgument, "page and limit must not be negative")
+    }
+    filter, err := newPaymentFilter(req)
+    if err != nil {
+        return nil, err
+    }
+
+    page, limit := int(max(req.Page, 1)), int(req.Limit)
+    if limit == 0 {
+        limit = defaultListLimit
+    }
+    limit = min(limit, maxListLimit)
+    first := (page - 1) * limit
+
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    // An order's payments are indexed, so there is no need to scan them all.
+    ids := s.paymentIDs
+    if filter.orderID != "" {
+        ids = s.byOrder[filter.orderID]
+    }
+
+    resp := &paymentPb.ListPaymentsResponse{}
+    for _, id := range ids {
+        payment := s.payments[id]
+        if !filter.matches(payment) {
+            continue
+        }
+        if n := int(resp.Total); n >= first && n < first+limit {
+            resp.Payments = append(resp.Payments, proto.Clone(payment).(*paymentPb.Payment))
+        }
+        resp.Total++
+    }
+
+    return resp, nil
+}
@@ -2,78 +2,170 @@ package main
 
 import (
     "context"
-    "fmt"
+    "crypto/rand"
     "log"
 		"os"
     "net"
+    "net/http"
+    "os/signal"
+    "strconv"
     "sync"
+    "sync/atomic"
+    "syscall"
     "time"
 
     paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
     orderPb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    userPb "github.com/AleksKislov/grpc_microservices_test/proto/user"
     "google.golang.org/grpc"
     "google.golang.org/grpc/codes"
     "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
 )
 
 type paymentService struct {
     paymentPb.UnimplementedPaymentServiceServer
     mu        sync.RWMutex
     payments  map[string]*paymentPb.Payment
+    // paymentIDs lists payment IDs in creation order, for stable listing.
+    paymentIDs []string
+    paymentSeq int
+    refundSeq  int
+    // inFlight maps an order ID to the payment currently being charged for
+    // it. At most one charge per order may be in flight.
+    inFlight map[string]string
+    // byOrder lists each order's payment IDs in creation order.
+    byOrder map[string][]string
+    // journal is the append-only ledger; journalByPayment indexes it.
+    journal          []*paymentPb.JournalEntry
+    journalSeq       int
+    journalByPayment map[string][]int
+    // disputes maps dispute IDs to their payment's ID.
+    disputes   map[string]string
+    disputeSeq int
+    // webhookEvents maps gateway event IDs to when they were applied; the
+    // zero time marks an event being applied.
+    webhookEvents map[string]time.Time
+    // webhookApplied lists applied event IDs oldest first, so expired ones
+    // are dropped from the front.
+    webhookApplied []string
+    // watchers maps payment IDs to a channel closed on their next status
+    // transition.
+    watchers map[string]chan struct{}
+    // methods maps tokens to tokenized payment methods.
+    methods map[string]*storedMethod
     orderClient orderPb.OrderServiceClient
+    // userClient is used by fraud screening and may be nil.
+    userClient userPb.UserServiceClient
+    gateway Gateway
+    config  paymentServiceConfig
+    // fraudRules is swapped as a whole when the rules file is reloaded.
+    fraudRules atomic.Pointer[fraudRules]
+    // workers tracks background goroutines, including async charges, so
+    // shutdown can wait for them.
+    workers sync.WaitGroup
 }
 
-func newPaymentService(orderClient orderPb.OrderServiceClient) *paymentService {
-    return &paymentService{
+// paymentServiceConfig holds the payment service's tunables.
+type paymentServiceConfig struct {
+    // authorizationTTL is how long a hold stays valid before it is voided
+    // automatically. Zero disables expiry.
+    authorizationTTL time.Duration
+    // retry applies to order service calls made after money has moved and
+    // to saga compensations.
+    retry retryPolicy
+    // fingerprintKey keys payment method fingerprints.
+    fingerprintKey []byte
+    fraudRules     *fraudRules
+    fees           feeSchedule
+    // webhookSecret signs gateway webhooks, which are accepted within
+    // webhookTolerance of their signature timestamp.
+    webhookSecret    []byte
+    webhookTolerance time.Duration
+    // disputeEvidenceWindow is how long evidence may be submitted for a
+    // dispute when its deadline is not given.
+    disputeEvidenceWindow time.Duration
+}
+
+func newPaymentService(orderClient orderPb.OrderServiceClient, userClient userPb.UserServiceClient, gateway Gateway, config paymentServiceConfig) *paymentService {
+    s := &paymentService{
         payments: make(map[string]*paymentPb.Payment),
+        inFlight: make(map[string]string),
+        byOrder: make(map[string][]string),
+        methods: make(map[string]*storedMethod),
+        journalByPayment: make(map[string][]int),
+        webhookEvents: make(map[string]time.Time),
+        disputes: make(map[string]string),
+        watchers: make(map[string]chan struct{}),
         orderClient: orderClient,
+        userClient: userClient,
+        gateway: gateway,
+        config: config,
     }
+    if config.fraudRules == nil {
+        config.fraudRules = defaultFraudRules()
+    }
+    s.fraudRules.Store(config.fraudRules)
+    return s
 }
 
+// ProcessPayment charges in one step: it authorizes, captures the full
+// amount and confirms the payment on the order. If the order cannot be
+// confirmed even after retries, the charge is refunded and the hold voided.
+// Async requests return the payment as PROCESSING and charge it in the
+// background.
 func (s *paymentService) ProcessPayment(ctx context.Context, req *paymentPb.ProcessPaymentRequest) (*paymentPb.PaymentResponse, error) {
-    orderReq := &orderPb.GetOrderRequest{
-        Id: req.OrderId,
-    }
-    
-    _, err := s.orderClient.GetOrder(ctx, orderReq)
-    if err != nil {
-        return nil, status.Errorf(codes.InvalidArgument, "order not found: %v", err)
-    }
-
-    s.mu.Lock()
-    defer s.mu.Unlock()
-
-    paymentId := fmt.Sprintf("payment_%d", len(s.payments)+1)
-
-    payment := &paymentPb.Payment{
-        Id:            paymentId,
-        OrderId:       req.OrderId,
-        UserId:        req.UserId,
+    payment, existing, err := s.reserveCharge(ctx, chargeRequest{
+        OrderID:       req.OrderId,
+        UserID:        req.UserId,
         Amount:        req.Amount,
-        Status:        "processing",
         PaymentMethod: req.PaymentMethod,
-        CreatedAt:     time.Now().Format(time.RFC3339),
+        Currency:      req.Currency,
+        AllowPartial:  req.AllowPartial,
+        Capture:       true,
+    })
+    if err != nil {
+        return nil, err
     }
-
-    payment.Status = "completed"
-
-    updateOrderReq := &orderPb.UpdateOrderRequest{
-        Id:     req.OrderId,
-        Status: "confirmed",
+    if existing || payment.Status == paymentPb.PaymentStatus_REVIEW {
+        return &paymentPb.PaymentResponse{Payment: payment}, nil
     }
+    if req.Async {
+        s.workers.Add(1)
+        go func() {
+            defer s.workers.Done()
+            defer s.releaseOrder(req.OrderId)
+            // Failures are recorded on the payment for WatchPayment.
+            s.runCheckout(context.WithoutCancel(ctx), payment)
+        }()
+        return &paymentPb.PaymentResponse{Payment: payment}, nil
+    }
+    defer s.releaseOrder(req.OrderId)
 
-    _, err = s.orderClient.UpdateOrder(ctx, updateOrderReq)
+    payment, err = s.runCheckout(ctx, payment)
     if err != nil {
-        payment.Status = "failed"
-        s.payments[paymentId] = payment
-        return nil, status.Errorf(codes.Internal, "failed to update order status: %v", err)
+        return nil, err
     }
 
-    s.payments[paymentId] = payment
-
     return &paymentPb.PaymentResponse{Payment: payment}, nil
 }
 
+// runCheckout authorizes, captures and confirms a claimed payment.
+func (s *paymentService) runCheckout(ctx context.Context, payment *paymentPb.Payment) (*paymentPb.Payment, error) {
+    record := &orderPb.RecordPaymentRequest{Kind: orderPb.PaymentRecordKind_PAYMENT_CAPTURED}
+    err := s.runSaga(ctx, payment.Id, "checkout", []sagaStep{
+        s.authorizeStep(payment.Id, nil),
+        s.captureStep(payment.Id, payment.Amount, record),
+        s.recordOnOrderStep("confirm_order", record),
+    })
+    if err != nil {
+        s.failPayment(payment.Id, err)
+        return nil, gatewayStatus(err)
+    }
+
+    return s.snapshot(payment.Id), nil
+}
+
 func (s *paymentService) GetPaymentStatus(ctx context.Context, req *paymentPb.GetPaymentStatusRequest) (*paymentPb.PaymentResponse, error) {
     s.mu.RLock()
     defer s.mu.RUnlock()
@@ -83,7 +175,7 @@ func (s *paymentService) GetPaymentStatus(ctx context.Context, req *paymentPb.Ge
         return nil, status.Errorf(codes.NotFound, "payment not found")
     }
 
-    return &paymentPb.PaymentResponse{Payment: payment}, nil
+    return &paymentPb.PaymentResponse{Payment: proto.Clone(payment).(*paymentPb.Payment)}, nil
 }
 
 func main() {
@@ -96,16 +188,160 @@ func main() {
 
     orderClient := orderPb.NewOrderServiceClient(orderConn)
 
+    userConn, err := grpc.Dial(os.Getenv("USER_SERVICE_ADDR"), grpc.WithInsecure())
+    if err != nil {
+        log.Fatalf("failed to connect to user service: %v", err)
+    }
+    defer userConn.Close()
+
+    userClient := userPb.NewUserServiceClient(userConn)
+
     lis, err := net.Listen("tcp", ":50051")
     if err != nil {
         log.Fatalf("failed to listen: %v", err)
     }
 
+    fraudRulesPath := os.Getenv("FRAUD_RULES")
+    rules, err := loadFraudRules(fraudRulesPath)
+    if err != nil {
+        log.Fatalf("failed to load fraud rules: %v", err)
+    }
+
+    config := paymentServiceConfig{
+        authorizationTTL: durationFromEnv("PAYMENT_AUTHORIZATION_TTL", 7*24*time.Hour),
+        retry: retryPolicy{
+            attempts:       intFromEnv("PAYMENT_RETRY_ATTEMPTS", 5),
+            initialBackoff: durationFromEnv("PAYMENT_RETRY_BACKOFF", 200*time.Millisecond),
+            maxBackoff:     durationFromEnv("PAYMENT_RETRY_MAX_BACKOFF", 5*time.Second),
+        },
+        fingerprintKey: secretFromEnv("PAYMENT_FINGERPRINT_KEY"),
+        fraudRules:     rules,
+        fees: feeSchedule{
+            rate:       floatFromEnv("PAYMENT_FEE_RATE", 0.029),
+            fixedCents: int64(intFromEnv("PAYMENT_FEE_FIXED_CENTS", 30)),
+        },
+        webhookSecret:    secretFromEnv("PAYMENT_WEBHOOK_SECRET"),
+        webhookTolerance: durationFromEnv("PAYMENT_WEBHOOK_TOLERANCE", 5*time.Minute),
+        disputeEvidenceWindow: durationFromEnv("PAYMENT_DISPUTE_EVIDENCE_WINDOW", 7*24*time.Hour),
+    }
+    webhookAddr := os.Getenv("PAYMENT_WEBHOOK_ADDR")
+    if webhookAddr == "" {
+        webhookAddr = ":8080"
+    }
+
+    simulator := simulatorConfigFromEnv(config.fingerprintKey)
+    simulator.WebhookSecret = config.webhookSecret
+    sweepInterval := durationFromEnv("PAYMENT_AUTHORIZATION_SWEEP_INTERVAL", time.Minute)
+    reloadInterval := durationFromEnv("FRAUD_RULES_RELOAD_INTERVAL", 10*time.Second)
+
+    service := newPaymentService(orderClient, userClient, newSimulatedGateway(simulator), config)
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    workers := &service.workers
+    if config.authorizationTTL > 0 && sweepInterval > 0 {
+        workers.Add(1)
+        go func() {
+            defer workers.Done()
+            service.runAuthorizationSweeper(ctx, sweepInterval)
+        }()
+    }
+    if fraudRulesPath != "" && reloadInterval > 0 {
+        workers.Add(1)
+        go func() {
+            defer workers.Done()
+            service.runFraudRulesReloader(ctx, fraudRulesPath, reloadInterval)
+        }()
+    }
+
     grpcServer := grpc.NewServer()
-    paymentPb.RegisterPaymentServiceServer(grpcServer, newPaymentService(orderClient))
+    paymentPb.RegisterPaymentServiceServer(grpcServer, service)
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/webhooks/gateway", service.handleWebhook)
+    webhookServer := &http.Server{Addr: webhookAddr, Handler: mux}
+    go func() {
+        log.Printf("Accepting gateway webhooks on %s", webhookAddr)
+        if err := webhookServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+            log.Fatalf("failed to serve webhooks: %v", err)
+        }
+    }()
+
+    go func() {
+        <-ctx.Done()
+        log.Println("Shutting down payment service")
+        shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        webhookServer.Shutdown(shutdownCtx)
+        grpcServer.GracefulStop()
+    }()
 
     log.Println("Starting payment service on :50053")
     if err := grpcServer.Serve(lis); err != nil {
         log.Fatalf("failed to serve: %v", err)
     }
+
+    stop()
+    workers.Wait()
+}
+
+// durationFromEnv parses a duration such as "30m" from the environment,
+// falling back to def when the variable is unset or invalid.
+func durationFromEnv(key string, def time.Duration) time.Duration {
+    value := os.Getenv(key)
+    if value == "" {
+        return def
+    }
+    d, err := time.ParseDuration(value)
+    if err != nil {
+        log.Printf("invalid %s %q, using %s", key, value, def)
+        return def
+    }
+    return d
+}
+
+// intFromEnv parses an integer from the environment, falling back to def
+// when the variable is unset or invalid.
+func intFromEnv(key string, def int) int {
+    value := os.Getenv(key)
+    if value == "" {
+        return def
+    }
+    n, err := strconv.Atoi(value)
+    if err != nil {
+        log.Printf("invalid %s %q, using %d", key, value, def)
+        return def
+    }
+    return n
+}
+
+// secretFromEnv reads a secret key from the environment. Without it a
+// random key is used, which only works within one process.
+func secretFromEnv(name string) []byte {
+    if key := os.Getenv(name); key != "" {
+        return []byte(key)
+    }
+
+    key := make([]byte, 32)
+    if _, err := rand.Read(key); err != nil {
+        log.Fatalf("failed to generate %s: %v", name, err)
+    }
+    log.Printf("%s is not set, using a random key", name)
+    return key
+}
+
+// floatFromEnv parses a number from the environment, falling back to def
+// when the variable is unset or invalid.
+func floatFromEnv(key string, def float64) float64 {
+    value := os.Getenv(key)
+    if value == "" {
+        return def
+    }
+    f, err := strconv.ParseFloat(value, 64)
+    if err != nil {
+        log.Printf("invalid %s %q, using %g", key, value, def)
+        return def
+    }
+    return f
 }
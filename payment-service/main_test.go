@@ -0,0 +1,129 @@
+package main
+
+import (
+    "context"
+    "sync"
+    "testing"
+    "time"
+
+    orderPb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+// failingRefunds is a simulated gateway whose refunds time out.
+type failingRefunds struct {
+    *simulatedGateway
+}
+
+func (failingRefunds) Refund(ctx context.Context, authorizationID string, amount float32) (string, error) {
+    return "", errGatewayTimeout
+}
+
+// newTestService returns a payment service for orders and a card token for
+// user_1.
+func newTestService(t *testing.T, orders orderPb.OrderServiceClient, gateway Gateway) (*paymentService, string) {
+    t.Helper()
+
+    s := newPaymentService(orders, nil, gateway, paymentServiceConfig{})
+    resp, err := s.TokenizePaymentMethod(context.Background(), &paymentPb.TokenizePaymentMethodRequest{
+        UserId: "user_1",
+        Details: &paymentPb.TokenizePaymentMethodRequest_Card{
+            Card: &paymentPb.CardDetails{Number: "4242424242424242", ExpMonth: 12, ExpYear: 2099, Cvc: "123"},
+        },
+    })
+    if err != nil {
+        t.Fatalf("TokenizePaymentMethod: %v", err)
+    }
+    return s, resp.PaymentMethod.Token
+}
+
+func pendingOrder() *orderPb.Order {
+    return &orderPb.Order{Id: "order_1", UserId: "user_1", TotalAmount: 30, Currency: "USD", Status: "pending"}
+}
+
+// TestCheckoutKeepsUncompensatedCapture fails a checkout after the capture
+// and fails the refund that should undo it. The payment must not read
+// FAILED with the money taken, and a retry must not charge again.
+func TestCheckoutKeepsUncompensatedCapture(t *testing.T) {
+    orders := &fakeOrderClient{order: pendingOrder(), recordErr: status.Errorf(codes.FailedPrecondition, "order cannot be paid")}
+    s, token := newTestService(t, orders, failingRefunds{newSimulatedGateway(simulatorConfig{})})
+    req := &paymentPb.ProcessPaymentRequest{OrderId: "order_1", UserId: "user_1", Amount: 30, Currency: "USD", PaymentMethod: token}
+
+    if _, err := s.ProcessPayment(context.Background(), req); err == nil {
+        t.Fatalf("ProcessPayment succeeded, want the confirmation failure")
+    }
+
+    payment := s.snapshot(s.byOrder["order_1"][0])
+    if payment.Status != paymentPb.PaymentStatus_CAPTURED || payment.CapturedAmount != 30 {
+        t.Fatalf("payment is %s with %.2f captured, want CAPTURED with 30", payment.Status, payment.CapturedAmount)
+    }
+    if state := payment.Sagas[len(payment.Sagas)-1].State; state != paymentPb.SagaState_SAGA_COMPENSATION_FAILED {
+        t.Errorf("saga is %s, want %s", state, paymentPb.SagaState_SAGA_COMPENSATION_FAILED)
+    }
+
+    resp, err := s.ProcessPayment(context.Background(), req)
+    if err != nil {
+        t.Fatalf("retried ProcessPayment: %v", err)
+    }
+    if resp.Payment.Id != payment.Id || len(s.byOrder["order_1"]) != 1 {
+        t.Errorf("retry made payment %s, %d payments in all, want the existing %s", resp.Payment.Id, len(s.byOrder["order_1"]), payment.Id)
+    }
+}
+
+// TestConcurrentProcessPayment fires parallel charges at one order. Run
+// with -race. Exactly one may reach the gateway; every other call must get
+// that payment back or be told a charge is already in progress.
+func TestConcurrentProcessPayment(t *testing.T) {
+    const callers = 10
+
+    gateway := newSimulatedGateway(simulatorConfig{Latency: 5 * time.Millisecond})
+    s, token := newTestService(t, &fakeOrderClient{order: pendingOrder()}, gateway)
+    req := &paymentPb.ProcessPaymentRequest{OrderId: "order_1", UserId: "user_1", Amount: 30, Currency: "USD", PaymentMethod: token}
+
+    var wg sync.WaitGroup
+    payments := make([]*paymentPb.Payment, callers)
+    errs := make([]error, callers)
+    for i := 0; i < callers; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            resp, err := s.ProcessPayment(context.Background(), req)
+            if err == nil {
+                payments[i] = resp.Payment
+            }
+            errs[i] = err
+        }(i)
+    }
+    wg.Wait()
+
+    if n := len(s.byOrder["order_1"]); n != 1 {
+        t.Fatalf("%d payments were created for the order, want 1", n)
+    }
+    paymentID := s.byOrder["order_1"][0]
+    for i, err := range errs {
+        switch {
+        case err == nil && payments[i].Id != paymentID:
+            t.Errorf("call %d got payment %s, want %s", i, payments[i].Id, paymentID)
+        case err != nil && status.Code(err) != codes.AlreadyExists:
+            t.Errorf("call %d failed with %v, want AlreadyExists", i, err)
+        }
+    }
+
+    var captures int
+    for _, entry := range s.journal {
+        if entry.Type == paymentPb.JournalEntryType_CAPTURE {
+            captures++
+        }
+    }
+    var captured int
+    for _, auth := range gateway.authorizations {
+        if auth.captured > 0 {
+            captured++
+        }
+    }
+    if captures != 1 || captured != 1 || len(gateway.authorizations) != 1 {
+        t.Errorf("ledger has %d captures, gateway %d captured of %d authorizations, want exactly one", captures, captured, len(gateway.authorizations))
+    }
+}
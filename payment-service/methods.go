@@ -0,0 +1,221 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "strings"
+    "time"
+
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
+)
+
+// walletProviders lists the wallets that can be tokenized.
+var walletProviders = map[string]bool{
+    "apple_pay":  true,
+    "google_pay": true,
+    "paypal":     true,
+}
+
+// storedMethod is a tokenized payment method. fingerprint identifies the
+// underlying card or account without revealing it; it never leaves the
+// service except to the gateway.
+type storedMethod struct {
+    method      *paymentPb.PaymentMethod
+    fingerprint string
+}
+
+// TokenizePaymentMethod validates the details and stores a token for them.
+// Full numbers are only held for the duration of the call and are never
+// included in errors or logs.
+func (s *paymentService) TokenizePaymentMethod(ctx context.Context, req *paymentPb.TokenizePaymentMethodRequest) (*paymentPb.TokenizePaymentMethodResponse, error) {
+    if req.UserId == "" {
+        return nil, status.Errorf(codes.InvalidArgument, "user_id is required")
+    }
+
+    method := &paymentPb.PaymentMethod{
+        UserId:    req.UserId,
+        CreatedAt: time.Now().Format(time.RFC3339),
+    }
+    var number string
+    switch details := req.Details.(type) {
+    case *paymentPb.TokenizePaymentMethodRequest_Card:
+        brand, err := validateCard(details.Card, time.Now())
+        if err != nil {
+            return nil, err
+        }
+        number = details.Card.Number
+        method.Type = paymentPb.PaymentMethodType_CARD
+        method.Brand = brand
+        method.ExpMonth = details.Card.ExpMonth
+        method.ExpYear = fullYear(details.Card.ExpYear)
+    case *paymentPb.TokenizePaymentMethodRequest_Wallet:
+        if !walletProviders[details.Wallet.Provider] {
+            return nil, status.Errorf(codes.InvalidArgument, "unsupported wallet provider %q", details.Wallet.Provider)
+        }
+        if details.Wallet.WalletToken == "" {
+            return nil, status.Errorf(codes.InvalidArgument, "wallet_token is required")
+        }
+        number = details.Wallet.Provider + ":" + details.Wallet.WalletToken
+        method.Type = paymentPb.PaymentMethodType_WALLET
+        method.WalletProvider = details.Wallet.Provider
+    case *paymentPb.TokenizePaymentMethodRequest_BankTransfer:
+        account, routing := details.BankTransfer.AccountNumber, details.BankTransfer.RoutingNumber
+        if !allDigits(account) || len(account) < 4 || len(account) > 17 {
+            return nil, status.Errorf(codes.InvalidArgument, "account_number must be 4 to 17 digits")
+        }
+        if !allDigits(routing) || len(routing) != 9 {
+            return nil, status.Errorf(codes.InvalidArgument, "routing_number must be 9 digits")
+        }
+        number = routing + ":" + account
+        method.Type = paymentPb.PaymentMethodType_BANK_TRANSFER
+    default:
+        return nil, status.Errorf(codes.InvalidArgument, "card, wallet or bank_transfer details are required")
+    }
+    if method.Type != paymentPb.PaymentMethodType_WALLET {
+        method.Last4 = number[len(number)-4:]
+    }
+
+    token, err := newToken()
+    if err != nil {
+        return nil, status.Errorf(codes.Internal, "failed to create token: %v", err)
+    }
+    method.Token = token
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.methods[token] = &storedMethod{
+        method:      method,
+        fingerprint: s.fingerprint(number),
+    }
+
+    return &paymentPb.TokenizePaymentMethodResponse{PaymentMethod: proto.Clone(method).(*paymentPb.PaymentMethod)}, nil
+}
+
+// paymentMethod looks up a token owned by userID.
+func (s *paymentService) paymentMethod(token, userID string) (*storedMethod, error) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    stored, exists := s.methods[token]
+    if !exists || stored.method.UserId != userID {
+        return nil, status.Errorf(codes.InvalidArgument, "payment_method must be a token from TokenizePaymentMethod for this user")
+    }
+    return stored, nil
+}
+
+// fingerprint keys a card or account number with the service's secret, so
+// the same number always gets the same fingerprint but the number cannot
+// be recovered from it.
+func (s *paymentService) fingerprint(number string) string {
+    return cardFingerprint(s.config.fingerprintKey, number)
+}
+
+func cardFingerprint(key []byte, number string) string {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(number))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validateCard checks a card's number, expiry and security code and returns
+// its brand.
+func validateCard(card *paymentPb.CardDetails, now time.Time) (paymentPb.CardBrand, error) {
+    number := card.Number
+    if !allDigits(number) || len(number) < 12 || len(number) > 19 {
+        return 0, status.Errorf(codes.InvalidArgument, "card number must be 12 to 19 digits")
+    }
+    if !luhnValid(number) {
+        return 0, status.Errorf(codes.InvalidArgument, "card number is invalid")
+    }
+
+    brand := cardBrand(number)
+    if brand == paymentPb.CardBrand_CARD_BRAND_UNSPECIFIED {
+        return 0, status.Errorf(codes.InvalidArgument, "card brand is not supported")
+    }
+
+    if card.ExpMonth < 1 || card.ExpMonth > 12 {
+        return 0, status.Errorf(codes.InvalidArgument, "exp_month must be between 1 and 12")
+    }
+    // A card is valid through the last day of its expiry month.
+    expires := time.Date(int(fullYear(card.ExpYear)), time.Month(card.ExpMonth)+1, 1, 0, 0, 0, 0, time.UTC)
+    if !now.Before(expires) {
+        return 0, status.Errorf(codes.InvalidArgument, "card has expired")
+    }
+
+    cvcLength := 3
+    if brand == paymentPb.CardBrand_AMEX {
+        cvcLength = 4
+    }
+    if !allDigits(card.Cvc) || len(card.Cvc) != cvcLength {
+        return 0, status.Errorf(codes.InvalidArgument, "cvc must be %d digits", cvcLength)
+    }
+
+    return brand, nil
+}
+
+// cardBrand identifies a card by its issuer prefix and length.
+func cardBrand(number string) paymentPb.CardBrand {
+    prefix := func(n int) int {
+        value := 0
+        for _, digit := range number[:n] {
+            value = value*10 + int(digit-'0')
+        }
+        return value
+    }
+    length := len(number)
+
+    switch {
+    case number[0] == '4' && (length == 13 || length == 16 || length == 19):
+        return paymentPb.CardBrand_VISA
+    case length == 16 && (prefix(2) >= 51 && prefix(2) <= 55 || prefix(4) >= 2221 && prefix(4) <= 2720):
+        return paymentPb.CardBrand_MASTERCARD
+    case length == 15 && (prefix(2) == 34 || prefix(2) == 37):
+        return paymentPb.CardBrand_AMEX
+    case (length == 16 || length == 19) && (prefix(4) == 6011 || prefix(2) == 65 || prefix(3) >= 644 && prefix(3) <= 649):
+        return paymentPb.CardBrand_DISCOVER
+    default:
+        return paymentPb.CardBrand_CARD_BRAND_UNSPECIFIED
+    }
+}
+
+// luhnValid verifies a number's check digit.
+func luhnValid(number string) bool {
+    sum := 0
+    double := false
+    for i := len(number) - 1; i >= 0; i-- {
+        digit := int(number[i] - '0')
+        if double {
+            if digit *= 2; digit > 9 {
+                digit -= 9
+            }
+        }
+        sum += digit
+        double = !double
+    }
+    return sum%10 == 0
+}
+
+func allDigits(value string) bool {
+    return value != "" && strings.Trim(value, "0123456789") == ""
+}
+
+func fullYear(year int32) int32 {
+    if year < 100 {
+        return 2000 + year
+    }
+    return year
+}
+
+func newToken() (string, error) {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return "pm_" + hex.EncodeToString(b), nil
+}
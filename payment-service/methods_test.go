@@ -0,0 +1,109 @@
+package main
+
+import (
+    "testing"
+    "time"
+
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+func TestLuhnValid(t *testing.T) {
+    tests := []struct {
+        number string
+        valid  bool
+    }{
+        {"79927398713", true},
+        {"4242424242424242", true},
+        {"5555555555554444", true},
+        {"378282246310005", true},
+        {"6011111111111117", true},
+        {"79927398710", false},
+        {"4242424242424241", false},
+        {"5555555555554445", false},
+        {"378282246310006", false},
+    }
+
+    for _, tt := range tests {
+        if got := luhnValid(tt.number); got != tt.valid {
+            t.Errorf("luhnValid(%q) = %v, want %v", tt.number, got, tt.valid)
+        }
+    }
+}
+
+func TestCardBrand(t *testing.T) {
+    tests := []struct {
+        number string
+        brand  paymentPb.CardBrand
+    }{
+        {"4222222222222", paymentPb.CardBrand_VISA},
+        {"4242424242424242", paymentPb.CardBrand_VISA},
+        {"4242424242424242424", paymentPb.CardBrand_VISA},
+        {"5555555555554444", paymentPb.CardBrand_MASTERCARD},
+        {"2223003122003222", paymentPb.CardBrand_MASTERCARD},
+        {"378282246310005", paymentPb.CardBrand_AMEX},
+        {"341111111111111", paymentPb.CardBrand_AMEX},
+        {"6011111111111117", paymentPb.CardBrand_DISCOVER},
+        {"6500000000000002", paymentPb.CardBrand_DISCOVER},
+        {"6445644564456445", paymentPb.CardBrand_DISCOVER},
+        {"3530111333300000", paymentPb.CardBrand_CARD_BRAND_UNSPECIFIED},
+        {"42424242424242", paymentPb.CardBrand_CARD_BRAND_UNSPECIFIED},
+        {"5555555555554", paymentPb.CardBrand_CARD_BRAND_UNSPECIFIED},
+    }
+
+    for _, tt := range tests {
+        if got := cardBrand(tt.number); got != tt.brand {
+            t.Errorf("cardBrand(%q) = %s, want %s", tt.number, got, tt.brand)
+        }
+    }
+}
+
+func TestValidateCard(t *testing.T) {
+    now := time.Date(2026, time.June, 15, 0, 0, 0, 0, time.UTC)
+
+    tests := []struct {
+        name     string
+        number   string
+        expMonth int32
+        expYear  int32
+        cvc      string
+        brand    paymentPb.CardBrand
+        code     codes.Code
+    }{
+        {name: "visa", number: "4242424242424242", expMonth: 12, expYear: 2030, cvc: "123", brand: paymentPb.CardBrand_VISA},
+        {name: "amex", number: "378282246310005", expMonth: 12, expYear: 2030, cvc: "1234", brand: paymentPb.CardBrand_AMEX},
+        {name: "spaces", number: "4242 4242 4242 4242", expMonth: 12, expYear: 2030, cvc: "123", code: codes.InvalidArgument},
+        {name: "dashes", number: "4242-4242-4242-4242", expMonth: 12, expYear: 2030, cvc: "123", code: codes.InvalidArgument},
+        {name: "letter", number: "42424242424242a2", expMonth: 12, expYear: 2030, cvc: "123", code: codes.InvalidArgument},
+        {name: "empty", number: "", expMonth: 12, expYear: 2030, cvc: "123", code: codes.InvalidArgument},
+        {name: "bad check digit", number: "4242424242424241", expMonth: 12, expYear: 2030, cvc: "123", code: codes.InvalidArgument},
+        {name: "unsupported brand", number: "3530111333300000", expMonth: 12, expYear: 2030, cvc: "123", code: codes.InvalidArgument},
+
+        {name: "expires this month", number: "4242424242424242", expMonth: 6, expYear: 2026, cvc: "123", brand: paymentPb.CardBrand_VISA},
+        {name: "expired last month", number: "4242424242424242", expMonth: 5, expYear: 2026, cvc: "123", code: codes.InvalidArgument},
+        {name: "expired last year", number: "4242424242424242", expMonth: 12, expYear: 2025, cvc: "123", code: codes.InvalidArgument},
+        {name: "two-digit year", number: "4242424242424242", expMonth: 6, expYear: 26, cvc: "123", brand: paymentPb.CardBrand_VISA},
+        {name: "two-digit year expired", number: "4242424242424242", expMonth: 5, expYear: 26, cvc: "123", code: codes.InvalidArgument},
+        {name: "exp_month 0", number: "4242424242424242", expMonth: 0, expYear: 2030, cvc: "123", code: codes.InvalidArgument},
+        {name: "exp_month 13", number: "4242424242424242", expMonth: 13, expYear: 2030, cvc: "123", code: codes.InvalidArgument},
+
+        {name: "amex with 3-digit cvc", number: "378282246310005", expMonth: 12, expYear: 2030, cvc: "123", code: codes.InvalidArgument},
+        {name: "visa with 4-digit cvc", number: "4242424242424242", expMonth: 12, expYear: 2030, cvc: "1234", code: codes.InvalidArgument},
+        {name: "mastercard with 3-digit cvc", number: "5555555555554444", expMonth: 12, expYear: 2030, cvc: "123", brand: paymentPb.CardBrand_MASTERCARD},
+        {name: "non-digit cvc", number: "4242424242424242", expMonth: 12, expYear: 2030, cvc: "12a", code: codes.InvalidArgument},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            card := &paymentPb.CardDetails{Number: tt.number, ExpMonth: tt.expMonth, ExpYear: tt.expYear, Cvc: tt.cvc}
+            brand, err := validateCard(card, now)
+            if code := status.Code(err); code != tt.code {
+                t.Fatalf("validateCard(%q) error = %v, want code %s", tt.number, err, tt.code)
+            }
+            if brand != tt.brand {
+                t.Errorf("validateCard(%q) brand = %s, want %s", tt.number, brand, tt.brand)
+            }
+        })
+    }
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "time"
+
+    orderPb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
+)
+
+// RefundPayment records pending refunds, sends them to the gateway without
+// holding the lock, and then settles the records. Pending refunds count
+// against the refundable amount, so concurrent refunds can never add up to
+// more than was captured. Neither can disputed amounts be refunded.
+func (s *paymentService) RefundPayment(ctx context.Context, req *paymentPb.RefundPaymentRequest) (*paymentPb.RefundPaymentResponse, error) {
+    if req.Amount <= 0 {
+        return nil, status.Errorf(codes.InvalidArgument, "refund amount must be positive")
+    }
+
+    planned, err := s.reserveRefunds(req)
+    if err != nil {
+        return nil, err
+    }
+
+    for i, p := range planned {
+        gatewayRef, err := s.gateway.Refund(ctx, p.payment.GatewayReference, p.refund.Amount)
+        if err != nil {
+            // The rest are not sent; a retry with the same key makes them.
+            for _, rest := range planned[i:] {
+                s.settleRefund(rest.payment.Id, rest.refund.Id, func(r *paymentPb.Refund) {
+                    r.Status = paymentPb.RefundStatus_REFUND_FAILED
+                    r.FailureReason = err.Error()
+                })
+            }
+            return nil, gatewayStatus(err)
+        }
+
+        payment, refund, err := s.settleRefund(p.payment.Id, p.refund.Id, func(r *paymentPb.Refund) {
+            r.Status = paymentPb.RefundStatus_REFUND_SUCCEEDED
+            r.GatewayReference = gatewayRef
+        })
+        if err != nil {
+            // The refund stays pending, so it still counts against what is
+            // refundable; the rest are not sent.
+            for _, rest := range planned[i+1:] {
+                s.settleRefund(rest.payment.Id, rest.refund.Id, func(r *paymentPb.Refund) {
+                    r.Status = paymentPb.RefundStatus_REFUND_FAILED
+                    r.FailureReason = err.Error()
+                })
+            }
+            return nil, err
+        }
+
+        // RecordRefund is idempotent by refund ID, so it is safe to retry.
+        _, err = s.attempt(context.WithoutCancel(ctx), true, func(ctx context.Context) error {
+            return s.notifyOrderOfRefund(ctx, payment, refund)
+        })
+        if err != nil {
+            // The money has moved; the refund stays marked as not applied to
+            // the order so reconciliation can catch up.
+            log.Printf("refund %s succeeded but the order was not updated: %v", refund.Id, err)
+        } else {
+            s.settleRefund(payment.Id, refund.Id, func(r *paymentPb.Refund) {
+                r.OrderUpdated = true
+            })
+        }
+    }
+
+    return s.refundResponse(req, planned), nil
+}
+
+// plannedRefund is a pending refund reserved by reserveRefunds.
+type plannedRefund struct {
+    payment *paymentPb.Payment
+    refund  *paymentPb.Refund
+}
+
+// refundResponse describes the refunds made for req: those made under its
+// idempotency key, or else the ones just planned.
+func (s *paymentService) refundResponse(req *paymentPb.RefundPaymentRequest, planned []plannedRefund) *paymentPb.RefundPaymentResponse {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    resp := &paymentPb.RefundPaymentResponse{}
+    add := func(payment *paymentPb.Payment, refund *paymentPb.Refund) {
+        if resp.Payment == nil {
+            resp.Payment = proto.Clone(payment).(*paymentPb.Payment)
+            resp.RefundId = refund.Id
+            resp.Refund = proto.Clone(refund).(*paymentPb.Refund)
+        }
+        resp.Refunds = append(resp.Refunds, proto.Clone(refund).(*paymentPb.Refund))
+    }
+
+    if req.IdempotencyKey != "" {
+        s.keyedRefunds(s.refundOrderID(req), req.IdempotencyKey, func(payment *paymentPb.Payment, refund *paymentPb.Refund) {
+            add(payment, refund)
+        })
+        return resp
+    }
+    for _, p := range planned {
+        payment := s.payments[p.payment.Id]
+        for _, refund := range payment.Refunds {
+            if refund.Id == p.refund.Id {
+                add(payment, refund)
+            }
+        }
+    }
+    return resp
+}
+
+func (s *paymentService) notifyOrderOfRefund(ctx context.Context, payment *paymentPb.Payment, refund *paymentPb.Refund) error {
+    _, err := s.orderClient.RecordRefund(ctx, &orderPb.RecordRefundRequest{
+        OrderId:   payment.OrderId,
+        PaymentId: payment.Id,
+        RefundId:  refund.Id,
+        Amount:    refund.Amount,
+        Currency:  payment.Currency,
+        Actor:     "payment-service",
+        Reason:    refund.Reason,
+    })
+    return err
+}
+
+// reserveRefunds records pending refunds covering what req asks for and
+// earlier attempts with its idempotency key did not. A refund by order is
+// spread over the order's refundable payments, oldest first.
+func (s *paymentService) reserveRefunds(req *paymentPb.RefundPaymentRequest) ([]plannedRefund, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    remaining := req.Amount
+    if req.IdempotencyKey != "" {
+        s.keyedRefunds(s.refundOrderID(req), req.IdempotencyKey, func(payment *paymentPb.Payment, refund *paymentPb.Refund) {
+            remaining -= refund.Amount
+        })
+        if remaining <= amountTolerance {
+            return nil, nil
+        }
+    }
+
+    payments, err := s.refundablePayments(req.PaymentId, req.OrderId)
+    if err != nil {
+        return nil, err
+    }
+
+    var refundable float32
+    for _, payment := range payments {
+        refundable += disputableAmount(payment)
+    }
+    if remaining > refundable+amountTolerance {
+        return nil, status.Errorf(codes.FailedPrecondition, "refund of %.2f exceeds the refundable %.2f", remaining, roundCents(refundable))
+    }
+
+    var planned []plannedRefund
+    for _, payment := range payments {
+        amount := min(remaining, disputableAmount(payment))
+        if amount <= amountTolerance {
+            continue
+        }
+
+        s.refundSeq++
+        refund := &paymentPb.Refund{
+            Id:             fmt.Sprintf("refund_%d", s.refundSeq),
+            PaymentId:      payment.Id,
+            Amount:         roundCents(amount),
+            Reason:         req.Reason,
+            Status:         paymentPb.RefundStatus_REFUND_PENDING,
+            CreatedAt:      time.Now().Format(time.RFC3339),
+            IdempotencyKey: req.IdempotencyKey,
+        }
+        payment.Refunds = append(payment.Refunds, refund)
+        planned = append(planned, plannedRefund{
+            payment: proto.Clone(payment).(*paymentPb.Payment),
+            refund:  proto.Clone(refund).(*paymentPb.Refund),
+        })
+
+        remaining -= amount
+        if remaining <= amountTolerance {
+            break
+        }
+    }
+    return planned, nil
+}
+
+// keyedRefunds calls fn for each refund of the order made under key that
+// did not fail. It must be called with s.mu held.
+func (s *paymentService) keyedRefunds(orderID, key string, fn func(*paymentPb.Payment, *paymentPb.Refund)) {
+    for _, paymentID := range s.byOrder[orderID] {
+        payment := s.payments[paymentID]
+        for _, refund := range payment.Refunds {
+            if refund.IdempotencyKey == key && refund.Status != paymentPb.RefundStatus_REFUND_FAILED {
+                fn(payment, refund)
+            }
+        }
+    }
+}
+
+// refundOrderID is the order a refund request is for. It must be called
+// with s.mu held.
+func (s *paymentService) refundOrderID(req *paymentPb.RefundPaymentRequest) string {
+    if payment, exists := s.payments[req.PaymentId]; exists {
+        return payment.OrderId
+    }
+    return req.OrderId
+}
+
+// settleRefund applies update to a refund record and re-derives the
+// payment's refunded amount and status from its succeeded refunds. A
+// refund that just succeeded is journaled; if the entry is refused, the
+// payment is left as it was. A compensation leaves the payment in the state
+// of what remains of its hold.
+func (s *paymentService) settleRefund(paymentID, refundID string, update func(*paymentPb.Refund)) (*paymentPb.Payment, *paymentPb.Refund, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    payment := proto.Clone(s.payments[paymentID]).(*paymentPb.Payment)
+    var refund *paymentPb.Refund
+    var refunded float32
+    for _, r := range payment.Refunds {
+        if r.Id == refundID {
+            succeeded := r.Status == paymentPb.RefundStatus_REFUND_SUCCEEDED
+            update(r)
+            refund = r
+            if !succeeded && r.Status == paymentPb.RefundStatus_REFUND_SUCCEEDED {
+                if err := s.postRefund(payment, r.Amount, r.Id); err != nil {
+                    return nil, nil, err
+                }
+            }
+        }
+        if r.Status == paymentPb.RefundStatus_REFUND_SUCCEEDED {
+            refunded += r.Amount
+        }
+    }
+
+    payment.RefundedAmount = roundCents(refunded)
+    switch {
+    case refund.Compensation:
+        payment.Status = holdStatus(payment)
+        if payment.Status == paymentPb.PaymentStatus_FAILED {
+            payment.FailureReason = refund.Reason
+        }
+    case payment.RefundedAmount >= payment.CapturedAmount-amountTolerance:
+        payment.Status = paymentPb.PaymentStatus_REFUNDED
+    case payment.RefundedAmount > 0:
+        payment.Status = paymentPb.PaymentStatus_PARTIALLY_REFUNDED
+    default:
+        payment.Status = paymentPb.PaymentStatus_CAPTURED
+    }
+    s.payments[paymentID] = payment
+    s.recordStatus(payment)
+
+    return proto.Clone(payment).(*paymentPb.Payment), proto.Clone(refund).(*paymentPb.Refund), nil
+}
+
+// holdStatus is the status of a payment's hold, not counting captures that
+// compensations refunded. A hold with nothing left to capture and nothing
+// captured has failed.
+func holdStatus(payment *paymentPb.Payment) paymentPb.PaymentStatus {
+    captured := roundCents(payment.CapturedAmount - compensatedAmount(payment))
+    open := payment.AuthorizedAmount-payment.CapturedAmount > amountTolerance
+    switch {
+    case open && captured > 0:
+        return paymentPb.PaymentStatus_PARTIALLY_CAPTURED
+    case open:
+        return paymentPb.PaymentStatus_AUTHORIZED
+    case captured > 0:
+        return paymentPb.PaymentStatus_CAPTURED
+    default:
+        return paymentPb.PaymentStatus_FAILED
+    }
+}
+
+// compensatedAmount is what compensations refunded.
+func compensatedAmount(payment *paymentPb.Payment) float32 {
+    var compensated float32
+    for _, refund := range payment.Refunds {
+        if refund.Compensation && refund.Status == paymentPb.RefundStatus_REFUND_SUCCEEDED {
+            compensated += refund.Amount
+        }
+    }
+    return compensated
+}
+
+func pendingRefunds(payment *paymentPb.Payment) float32 {
+    var pending float32
+    for _, refund := range payment.Refunds {
+        if refund.Status == paymentPb.RefundStatus_REFUND_PENDING {
+            pending += refund.Amount
+        }
+    }
+    return pending
+}
+
+// refundablePayments looks a payment up by ID, or else lists the order's
+// refundable payments in creation order. It must be called with s.mu held.
+func (s *paymentService) refundablePayments(paymentID, orderID string) ([]*paymentPb.Payment, error) {
+    if paymentID != "" {
+        payment, exists := s.payments[paymentID]
+        if !exists {
+            return nil, status.Errorf(codes.NotFound, "payment not found")
+        }
+        if !refundable(payment) {
+            return nil, status.Errorf(codes.FailedPrecondition, "payment is %s and cannot be refunded", payment.Status)
+        }
+        return []*paymentPb.Payment{payment}, nil
+    }
+
+    var payments []*paymentPb.Payment
+    for _, paymentID := range s.byOrder[orderID] {
+        if payment := s.payments[paymentID]; refundable(payment) {
+            payments = append(payments, payment)
+        }
+    }
+    if len(payments) == 0 {
+        return nil, status.Errorf(codes.NotFound, "no refundable payment for order %s", orderID)
+    }
+    return payments, nil
+}
+
+// refundable reports whether a payment's captures are final and not fully
+// refunded yet. Partially captured holds must be captured or voided first.
+func refundable(payment *paymentPb.Payment) bool {
+    return payment.Status == paymentPb.PaymentStatus_CAPTURED || payment.Status == paymentPb.PaymentStatus_PARTIALLY_REFUNDED
+}
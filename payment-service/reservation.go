@@ -0,0 +1,159 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "time"
+
+    orderPb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
+)
+
+// reservePayment claims the order for a new charge and stores the payment
+// as processing. If earlier captures already settle the order, the latest
+// of them is returned with existing set instead, so retrying a successful
+// payment never charges twice. Only then is the charge validated against
+// the order, which a successful payment will have confirmed. The checks and
+// the claim happen in one critical section, so they hold under concurrent
+// requests; the caller must call releaseOrder once the charge has been
+// authorized or has failed.
+func (s *paymentService) reservePayment(req chargeRequest, order *orderPb.Order, method *paymentPb.PaymentMethod) (payment *paymentPb.Payment, existing bool, err error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    captured, committed, latest := s.orderTotals(req.OrderID)
+    if latest != nil && captured >= order.TotalAmount-amountTolerance {
+        return proto.Clone(latest).(*paymentPb.Payment), true, nil
+    }
+
+    if paymentID, busy := s.inFlight[req.OrderID]; busy {
+        return nil, false, status.Errorf(codes.AlreadyExists, "payment %s for order %s is already in progress", paymentID, req.OrderID)
+    }
+
+    if err := validatePaymentForOrder(order, req); err != nil {
+        return nil, false, err
+    }
+
+    if committed+req.Amount > order.TotalAmount+amountTolerance {
+        return nil, false, status.Errorf(codes.FailedPrecondition, "order %s has %.2f left to pay", req.OrderID, order.TotalAmount-committed)
+    }
+
+    s.paymentSeq++
+    payment = &paymentPb.Payment{
+        Id:            fmt.Sprintf("payment_%d", s.paymentSeq),
+        OrderId:       req.OrderID,
+        UserId:        req.UserID,
+        Amount:        req.Amount,
+        Currency:      order.Currency,
+        Status:        paymentPb.PaymentStatus_PROCESSING,
+        PaymentMethod: req.PaymentMethod,
+        Method:        proto.Clone(method).(*paymentPb.PaymentMethod),
+        CreatedAt:     time.Now().Format(time.RFC3339),
+    }
+    s.payments[payment.Id] = payment
+    s.paymentIDs = append(s.paymentIDs, payment.Id)
+    s.byOrder[req.OrderID] = append(s.byOrder[req.OrderID], payment.Id)
+    s.inFlight[req.OrderID] = payment.Id
+    s.recordStatus(payment)
+
+    return proto.Clone(payment).(*paymentPb.Payment), false, nil
+}
+
+// releaseOrder lets the next charge for an order proceed.
+func (s *paymentService) releaseOrder(orderID string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if paymentID, exists := s.inFlight[orderID]; exists {
+        delete(s.inFlight, orderID)
+        s.wakeWatchers(paymentID)
+    }
+}
+
+// updatePayment applies update to a stored payment under the lock and
+// returns a copy of the result.
+func (s *paymentService) updatePayment(paymentID string, update func(*paymentPb.Payment)) *paymentPb.Payment {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    payment := s.payments[paymentID]
+    update(payment)
+    s.recordStatus(payment)
+    return proto.Clone(payment).(*paymentPb.Payment)
+}
+
+// updateJournaled applies an update that posts to the ledger. The update
+// works on a copy that only replaces the stored payment if it succeeds, so
+// a refused entry leaves the payment and the journal as they were.
+func (s *paymentService) updateJournaled(paymentID string, update func(*paymentPb.Payment) error) (*paymentPb.Payment, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    payment := proto.Clone(s.payments[paymentID]).(*paymentPb.Payment)
+    mark := len(s.journal)
+    if err := update(payment); err != nil {
+        s.dropEntries(mark)
+        return nil, err
+    }
+    s.payments[paymentID] = payment
+    s.recordStatus(payment)
+    return proto.Clone(payment).(*paymentPb.Payment), nil
+}
+
+// snapshot returns a copy of a stored payment.
+func (s *paymentService) snapshot(paymentID string) *paymentPb.Payment {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    return proto.Clone(s.payments[paymentID]).(*paymentPb.Payment)
+}
+
+// failPayment marks a payment declined or failed, depending on err. A
+// payment whose saga could not undo the money it moved keeps the status of
+// its hold and captures instead, so that money is still counted for the
+// order and reconciliation finds it.
+func (s *paymentService) failPayment(paymentID string, err error) *paymentPb.Payment {
+    return s.updatePayment(paymentID, func(payment *paymentPb.Payment) {
+        payment.FailureReason = err.Error()
+        var decline *declineError
+        switch {
+        case compensationFailed(payment):
+            payment.Status = holdStatus(payment)
+        case errors.As(err, &decline):
+            payment.Status = paymentPb.PaymentStatus_DECLINED
+        default:
+            payment.Status = paymentPb.PaymentStatus_FAILED
+        }
+    })
+}
+
+// compensationFailed reports whether the payment's last saga failed to
+// compensate a step.
+func compensationFailed(payment *paymentPb.Payment) bool {
+    n := len(payment.Sagas)
+    return n > 0 && payment.Sagas[n-1].State == paymentPb.SagaState_SAGA_COMPENSATION_FAILED
+}
+
+// orderTotals returns how much has been captured for an order, how much is
+// committed to it (captured, held or being charged), and its most recent
+// captured payment. It must be called with s.mu held.
+func (s *paymentService) orderTotals(orderID string) (captured, committed float32, latest *paymentPb.Payment) {
+    for _, paymentID := range s.byOrder[orderID] {
+        payment := s.payments[paymentID]
+        switch payment.Status {
+        case paymentPb.PaymentStatus_PROCESSING, paymentPb.PaymentStatus_REVIEW:
+            committed += payment.Amount
+        case paymentPb.PaymentStatus_AUTHORIZED, paymentPb.PaymentStatus_PARTIALLY_CAPTURED:
+            captured += payment.CapturedAmount
+            committed += payment.AuthorizedAmount
+        case paymentPb.PaymentStatus_CAPTURED, paymentPb.PaymentStatus_PARTIALLY_REFUNDED, paymentPb.PaymentStatus_REFUNDED:
+            captured += payment.CapturedAmount
+            committed += payment.CapturedAmount
+            latest = payment
+        }
+    }
+    return captured, committed, latest
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "log"
+    "time"
+
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+// sagaStep is one step of a payment saga. A step with a nil action has
+// already happened before the saga started and only contributes its
+// compensation.
+type sagaStep struct {
+    name       string
+    action     func(ctx context.Context) error
+    compensate func(ctx context.Context) error
+    // retry says whether a failing action is retried with backoff. Only
+    // idempotent actions may be retried.
+    retry bool
+}
+
+// retryPolicy bounds how often and how patiently transient failures are
+// retried.
+type retryPolicy struct {
+    attempts       int
+    initialBackoff time.Duration
+    maxBackoff     time.Duration
+}
+
+// runSaga runs steps in order, recording each one on the payment as it
+// goes. When a step fails, the steps that completed are compensated in
+// reverse order and the step's error is returned.
+//
+// The saga runs detached from ctx's cancellation: once money has moved,
+// leaving the payment half-finished because the caller went away is worse
+// than making the caller wait. No lock is held while a step runs.
+func (s *paymentService) runSaga(ctx context.Context, paymentID, name string, steps []sagaStep) error {
+    ctx = context.WithoutCancel(ctx)
+    saga := s.startSaga(paymentID, name, steps)
+
+    for i, step := range steps {
+        if step.action == nil {
+            s.recordStep(paymentID, saga, i, paymentPb.SagaStepStatus_STEP_SUCCEEDED, 0, nil)
+            continue
+        }
+
+        attempts, err := s.attempt(ctx, step.retry, step.action)
+        if err == nil {
+            s.recordStep(paymentID, saga, i, paymentPb.SagaStepStatus_STEP_SUCCEEDED, attempts, nil)
+            continue
+        }
+
+        s.recordStep(paymentID, saga, i, paymentPb.SagaStepStatus_STEP_FAILED, attempts, err)
+        s.compensate(ctx, paymentID, saga, steps[:i])
+        return err
+    }
+
+    s.finishSaga(paymentID, saga, paymentPb.SagaState_SAGA_COMPLETED)
+    return nil
+}
+
+func (s *paymentService) compensate(ctx context.Context, paymentID string, saga int, done []sagaStep) {
+    s.finishSaga(paymentID, saga, paymentPb.SagaState_SAGA_COMPENSATING)
+
+    state := paymentPb.SagaState_SAGA_COMPENSATED
+    for i := len(done) - 1; i >= 0; i-- {
+        if done[i].compensate == nil {
+            continue
+        }
+        attempts, err := s.attempt(ctx, true, done[i].compensate)
+        if err != nil {
+            log.Printf("payment %s: failed to compensate %s: %v", paymentID, done[i].name, err)
+            s.recordStep(paymentID, saga, i, paymentPb.SagaStepStatus_STEP_COMPENSATION_FAILED, attempts, err)
+            state = paymentPb.SagaState_SAGA_COMPENSATION_FAILED
+            continue
+        }
+        s.recordStep(paymentID, saga, i, paymentPb.SagaStepStatus_STEP_COMPENSATED, attempts, nil)
+    }
+
+    s.finishSaga(paymentID, saga, state)
+}
+
+// attempt runs fn once, or with retry until it succeeds, fails permanently
+// or runs out of attempts. It returns the number of attempts made.
+func (s *paymentService) attempt(ctx context.Context, retry bool, fn func(context.Context) error) (int, error) {
+    policy := s.config.retry
+    if !retry || policy.attempts < 1 {
+        policy.attempts = 1
+    }
+
+    backoff := policy.initialBackoff
+    var err error
+    for attempt := 1; ; attempt++ {
+        if err = fn(ctx); err == nil || attempt >= policy.attempts || !retryable(err) {
+            return attempt, err
+        }
+
+        select {
+        case <-ctx.Done():
+            return attempt, err
+        case <-time.After(backoff):
+        }
+        backoff = min(backoff*2, policy.maxBackoff)
+    }
+}
+
+// retryable reports whether err is transient and did not change anything,
+// so repeating the call is safe. A gateway timeout is not retryable: the
+// operation may have gone through.
+func retryable(err error) bool {
+    if errors.Is(err, errGatewayUnavailable) {
+        return true
+    }
+    switch status.Code(err) {
+    case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted, codes.ResourceExhausted:
+        return true
+    default:
+        return false
+    }
+}
+
+// startSaga appends a saga with all steps pending to the payment and
+// returns its index.
+func (s *paymentService) startSaga(paymentID, name string, steps []sagaStep) int {
+    now := time.Now().Format(time.RFC3339)
+    saga := &paymentPb.Saga{
+        Name:      name,
+        State:     paymentPb.SagaState_SAGA_RUNNING,
+        StartedAt: now,
+    }
+    for _, step := range steps {
+        saga.Steps = append(saga.Steps, &paymentPb.SagaStep{
+            Name:      step.name,
+            Status:    paymentPb.SagaStepStatus_STEP_PENDING,
+            UpdatedAt: now,
+        })
+    }
+
+    var index int
+    s.updatePayment(paymentID, func(p *paymentPb.Payment) {
+        index = len(p.Sagas)
+        p.Sagas = append(p.Sagas, saga)
+    })
+    return index
+}
+
+func (s *paymentService) recordStep(paymentID string, saga, step int, st paymentPb.SagaStepStatus, attempts int, err error) {
+    s.updatePayment(paymentID, func(p *paymentPb.Payment) {
+        record := p.Sagas[saga].Steps[step]
+        record.Status = st
+        record.Attempts += int32(attempts)
+        record.UpdatedAt = time.Now().Format(time.RFC3339)
+        if err != nil {
+            record.LastError = err.Error()
+        }
+    })
+}
+
+func (s *paymentService) finishSaga(paymentID string, saga int, state paymentPb.SagaState) {
+    s.updatePayment(paymentID, func(p *paymentPb.Payment) {
+        p.Sagas[saga].State = state
+        if state != paymentPb.SagaState_SAGA_RUNNING && state != paymentPb.SagaState_SAGA_COMPENSATING {
+            p.Sagas[saga].FinishedAt = time.Now().Format(time.RFC3339)
+        }
+    })
+}
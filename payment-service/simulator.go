@@ -0,0 +1,393 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "math/rand"
+    "os"
+    "strconv"
+    "strings"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+)
+
+// webhookDeliveryAttempts bounds how often the simulator redelivers an
+// event that is not acknowledged.
+const webhookDeliveryAttempts = 8
+
+// simulatorConfig controls how the simulated gateway misbehaves.
+type simulatorConfig struct {
+    // DeclineCards maps a payment method fingerprint to the decline code it
+    // gets. Card numbers are only seen while the config is read.
+    DeclineCards map[string]string
+    // TimeoutCards never get an answer: the call blocks for Timeout and
+    // then fails with errGatewayTimeout.
+    TimeoutCards map[string]bool
+    Timeout      time.Duration
+    // Latency is added to every call.
+    Latency time.Duration
+    // FailureRate is the probability, in [0, 1], that any call fails with
+    // errGatewayUnavailable.
+    FailureRate float64
+
+    // WebhookURL receives an event, signed with WebhookSecret, WebhookDelay
+    // after each capture, refund and decline. Empty disables webhooks.
+    WebhookURL    string
+    WebhookSecret []byte
+    WebhookDelay  time.Duration
+    // DisputeCards have every capture disputed, with the given reason. The
+    // simulator decides a dispute once evidence is submitted: it is won if
+    // the evidence includes a file and lost otherwise.
+    DisputeCards map[string]string
+}
+
+// defaultDeclineCards follow the usual PSP test card conventions.
+var defaultDeclineCards = map[string]string{
+    "4000000000000002": "card_declined",
+    "4000000000009995": "insufficient_funds",
+    "4000000000000069": "expired_card",
+}
+
+// simulatorConfigFromEnv reads GATEWAY_SIM_* variables. Card lists are comma
+// separated; declines may be given as card:code. Cards are stored by their
+// fingerprint under key.
+func simulatorConfigFromEnv(key []byte) simulatorConfig {
+    config := simulatorConfig{
+        DeclineCards: make(map[string]string),
+        TimeoutCards: make(map[string]bool),
+        Timeout:      5 * time.Second,
+        WebhookURL:   os.Getenv("GATEWAY_SIM_WEBHOOK_URL"),
+        WebhookDelay: time.Second,
+        DisputeCards: make(map[string]string),
+    }
+    for card, code := range defaultDeclineCards {
+        config.DeclineCards[cardFingerprint(key, card)] = code
+    }
+
+    for _, entry := range splitList(os.Getenv("GATEWAY_SIM_DECLINE_CARDS")) {
+        card, code, found := strings.Cut(entry, ":")
+        if !found {
+            code = "card_declined"
+        }
+        config.DeclineCards[cardFingerprint(key, card)] = code
+    }
+    for _, card := range splitList(os.Getenv("GATEWAY_SIM_TIMEOUT_CARDS")) {
+        config.TimeoutCards[cardFingerprint(key, card)] = true
+    }
+    for _, entry := range splitList(os.Getenv("GATEWAY_SIM_DISPUTE_CARDS")) {
+        card, reason, found := strings.Cut(entry, ":")
+        if !found {
+            reason = "fraudulent"
+        }
+        config.DisputeCards[cardFingerprint(key, card)] = reason
+    }
+    if d, err := time.ParseDuration(os.Getenv("GATEWAY_SIM_WEBHOOK_DELAY")); err == nil {
+        config.WebhookDelay = d
+    }
+    if d, err := time.ParseDuration(os.Getenv("GATEWAY_SIM_TIMEOUT")); err == nil {
+        config.Timeout = d
+    }
+    if d, err := time.ParseDuration(os.Getenv("GATEWAY_SIM_LATENCY")); err == nil {
+        config.Latency = d
+    }
+    if rate, err := strconv.ParseFloat(os.Getenv("GATEWAY_SIM_FAILURE_RATE"), 64); err == nil {
+        config.FailureRate = rate
+    }
+
+    return config
+}
+
+func splitList(value string) []string {
+    var items []string
+    for _, item := range strings.Split(value, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            items = append(items, item)
+        }
+    }
+    return items
+}
+
+type simulatedAuthorization struct {
+    paymentID   string
+    fingerprint string
+    amount   float32
+    captured float32
+    refunded float32
+    voided   bool
+}
+
+type simulatedDispute struct {
+    authorizationID string
+    amount          float32
+    closed          bool
+}
+
+// simulatedGateway is an in-memory Gateway for local development. It keeps
+// enough state to reject captures, voids and refunds a real PSP would.
+type simulatedGateway struct {
+    config simulatorConfig
+
+    mu             sync.Mutex
+    rand           *rand.Rand
+    seq            int
+    authorizations map[string]*simulatedAuthorization
+    disputes       map[string]*simulatedDispute
+    // eventSeq numbers webhook events; it is atomic so events can be sent
+    // with or without g.mu held.
+    eventSeq atomic.Int64
+}
+
+func newSimulatedGateway(config simulatorConfig) *simulatedGateway {
+    return &simulatedGateway{
+        config:         config,
+        rand:           rand.New(rand.NewSource(time.Now().UnixNano())),
+        authorizations: make(map[string]*simulatedAuthorization),
+        disputes:       make(map[string]*simulatedDispute),
+    }
+}
+
+func (g *simulatedGateway) Authorize(ctx context.Context, req gatewayAuthorization) (string, error) {
+    if err := g.simulateCall(ctx, req.Fingerprint); err != nil {
+        return "", err
+    }
+    if code, declined := g.config.DeclineCards[req.Fingerprint]; declined {
+        decline := &declineError{Code: code, Reason: strings.ReplaceAll(code, "_", " ")}
+        g.sendWebhook(webhookPaymentFailed, webhookData{
+            PaymentID: req.PaymentID,
+            Code:      decline.Code,
+            Reason:    decline.Reason,
+        })
+        return "", decline
+    }
+
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    id := g.nextID("auth")
+    g.authorizations[id] = &simulatedAuthorization{
+        paymentID:   req.PaymentID,
+        fingerprint: req.Fingerprint,
+        amount:      req.Amount,
+    }
+    return id, nil
+}
+
+func (g *simulatedGateway) Capture(ctx context.Context, authorizationID string, amount float32) (string, error) {
+    if err := g.simulateCall(ctx, ""); err != nil {
+        return "", err
+    }
+
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    auth, err := g.authorization(authorizationID)
+    if err != nil {
+        return "", err
+    }
+    if auth.voided {
+        return "", fmt.Errorf("authorization %s was voided", authorizationID)
+    }
+    if auth.captured+amount > auth.amount+amountTolerance {
+        return "", fmt.Errorf("capture of %.2f exceeds the uncaptured %.2f", amount, auth.amount-auth.captured)
+    }
+
+    auth.captured += amount
+    captureID := g.nextID("capture")
+    g.sendWebhook(webhookPaymentSucceeded, webhookData{
+        PaymentID:       auth.paymentID,
+        AuthorizationID: authorizationID,
+        CaptureID:       captureID,
+        Amount:          amount,
+    })
+    if reason, disputed := g.config.DisputeCards[auth.fingerprint]; disputed {
+        disputeID := g.nextID("dispute")
+        g.disputes[disputeID] = &simulatedDispute{authorizationID: authorizationID, amount: amount}
+        g.sendWebhook(webhookPaymentDisputed, webhookData{
+            PaymentID:       auth.paymentID,
+            AuthorizationID: authorizationID,
+            DisputeID:       disputeID,
+            Amount:          amount,
+            Reason:          reason,
+            EvidenceDueBy:   time.Now().Add(7 * 24 * time.Hour).Unix(),
+        })
+    }
+    return captureID, nil
+}
+
+func (g *simulatedGateway) Void(ctx context.Context, authorizationID string) error {
+    if err := g.simulateCall(ctx, ""); err != nil {
+        return err
+    }
+
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    auth, err := g.authorization(authorizationID)
+    if err != nil {
+        return err
+    }
+    if auth.voided {
+        return fmt.Errorf("authorization %s was already voided", authorizationID)
+    }
+
+    // Voiding a partially captured authorization releases the remainder.
+    auth.voided = true
+    return nil
+}
+
+func (g *simulatedGateway) Refund(ctx context.Context, authorizationID string, amount float32) (string, error) {
+    if err := g.simulateCall(ctx, ""); err != nil {
+        return "", err
+    }
+
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    auth, err := g.authorization(authorizationID)
+    if err != nil {
+        return "", err
+    }
+    if auth.refunded+amount > auth.captured+amountTolerance {
+        return "", fmt.Errorf("refund of %.2f exceeds the unrefunded %.2f", amount, auth.captured-auth.refunded)
+    }
+
+    auth.refunded += amount
+    refundID := g.nextID("refund")
+    g.sendWebhook(webhookPaymentRefunded, webhookData{
+        PaymentID:       auth.paymentID,
+        AuthorizationID: authorizationID,
+        RefundID:        refundID,
+        Amount:          amount,
+    })
+    return refundID, nil
+}
+
+func (g *simulatedGateway) SubmitDisputeEvidence(ctx context.Context, disputeID string, evidence *paymentPb.DisputeEvidence) error {
+    if err := g.simulateCall(ctx, ""); err != nil {
+        return err
+    }
+
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    dispute, exists := g.disputes[disputeID]
+    if !exists {
+        return fmt.Errorf("unknown dispute %s", disputeID)
+    }
+    if dispute.closed {
+        return fmt.Errorf("dispute %s is already closed", disputeID)
+    }
+
+    dispute.closed = true
+    outcome := "lost"
+    if len(evidence.Files) > 0 {
+        outcome = "won"
+    }
+    g.sendWebhook(webhookDisputeClosed, webhookData{
+        PaymentID:       g.authorizations[dispute.authorizationID].paymentID,
+        AuthorizationID: dispute.authorizationID,
+        DisputeID:       disputeID,
+        Amount:          dispute.amount,
+        Outcome:         outcome,
+    })
+    return nil
+}
+
+// simulateCall applies the configured latency, timeouts and intermittent
+// failures. fingerprint is empty for calls that do not carry a card.
+func (g *simulatedGateway) simulateCall(ctx context.Context, fingerprint string) error {
+    delay := g.config.Latency
+    timeout := g.config.TimeoutCards[fingerprint]
+    if timeout {
+        delay = g.config.Timeout
+    }
+
+    if delay > 0 {
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(delay):
+        }
+    }
+    if timeout {
+        return errGatewayTimeout
+    }
+
+    g.mu.Lock()
+    fail := g.config.FailureRate > 0 && g.rand.Float64() < g.config.FailureRate
+    g.mu.Unlock()
+    if fail {
+        return errGatewayUnavailable
+    }
+
+    return nil
+}
+
+// authorization must be called with g.mu held.
+func (g *simulatedGateway) authorization(id string) (*simulatedAuthorization, error) {
+    auth, exists := g.authorizations[id]
+    if !exists {
+        return nil, fmt.Errorf("unknown authorization %s", id)
+    }
+    return auth, nil
+}
+
+// nextID must be called with g.mu held.
+func (g *simulatedGateway) nextID(prefix string) string {
+    g.seq++
+    return fmt.Sprintf("sim_%s_%d", prefix, g.seq)
+}
+
+// sendWebhook delivers an event in the background after the configured
+// delay, redelivering with backoff until it is acknowledged, like a real
+// PSP. Call it only after the state change it reports.
+func (g *simulatedGateway) sendWebhook(eventType string, data webhookData) {
+    if g.config.WebhookURL == "" {
+        return
+    }
+
+    event := webhookEvent{
+        ID:      fmt.Sprintf("evt_%d_%d", time.Now().UnixNano(), g.eventSeq.Add(1)),
+        Type:    eventType,
+        Created: time.Now().Unix(),
+        Data:    data,
+    }
+    body, err := json.Marshal(event)
+    if err != nil {
+        log.Printf("simulator: failed to encode webhook: %v", err)
+        return
+    }
+
+    go func() {
+        backoff := g.config.WebhookDelay
+        for attempt := 1; attempt <= webhookDeliveryAttempts; attempt++ {
+            time.Sleep(backoff)
+            backoff = max(2*backoff, time.Second)
+
+            req, err := http.NewRequest(http.MethodPost, g.config.WebhookURL, bytes.NewReader(body))
+            if err != nil {
+                log.Printf("simulator: failed to build webhook: %v", err)
+                return
+            }
+            req.Header.Set("Content-Type", "application/json")
+            req.Header.Set(webhookSignatureHeader, signWebhook(g.config.WebhookSecret, time.Now(), body))
+
+            resp, err := http.DefaultClient.Do(req)
+            if err == nil {
+                resp.Body.Close()
+                if resp.StatusCode/100 == 2 {
+                    return
+                }
+                err = fmt.Errorf("status %s", resp.Status)
+            }
+            log.Printf("simulator: delivering webhook %s failed (attempt %d): %v", event.ID, attempt, err)
+        }
+    }()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+    "math"
+    "strings"
+
+    orderPb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+// amountTolerance absorbs float32 rounding when comparing money amounts.
+const amountTolerance = 0.005
+
+// chargeRequest is what ProcessPayment and AuthorizePayment have in common.
+type chargeRequest struct {
+    OrderID       string
+    UserID        string
+    Amount        float32
+    // PaymentMethod is a payment method token.
+    PaymentMethod string
+    Currency      string
+    AllowPartial  bool
+    // Capture is set for ProcessPayment, which captures right away.
+    Capture bool
+}
+
+// validatePayer checks that the order belongs to the payer. It runs before
+// anything else about the order is looked at, including earlier payments
+// and fraud screening, so no fraud rule needs to score it.
+func validatePayer(order *orderPb.Order, req chargeRequest) error {
+    if order.UserId != req.UserID {
+        return status.Errorf(codes.FailedPrecondition, "order %s does not belong to user %s", order.Id, req.UserID)
+    }
+    return nil
+}
+
+// validatePaymentForOrder checks that a charge may be made against order:
+// it must still be payable, and the amount and currency must match the
+// outstanding balance. Partial payments must be asked for explicitly.
+func validatePaymentForOrder(order *orderPb.Order, req chargeRequest) error {
+    if order.Status != "pending" && order.Status != "partially_paid" {
+        return status.Errorf(codes.FailedPrecondition, "order %s is %s and cannot be paid", order.Id, order.Status)
+    }
+    if !strings.EqualFold(req.Currency, order.Currency) {
+        return status.Errorf(codes.FailedPrecondition, "currency %s does not match order currency %s", req.Currency, order.Currency)
+    }
+
+    outstanding := outstandingBalance(order)
+    switch {
+    case req.Amount <= 0:
+        return status.Errorf(codes.InvalidArgument, "amount must be positive")
+    case req.Amount > outstanding+amountTolerance:
+        return status.Errorf(codes.FailedPrecondition, "amount %.2f exceeds the outstanding balance of %.2f", req.Amount, outstanding)
+    case !req.AllowPartial && req.Amount < outstanding-amountTolerance:
+        return status.Errorf(codes.FailedPrecondition, "amount %.2f does not equal the outstanding balance of %.2f, set allow_partial to pay part of it", req.Amount, outstanding)
+    }
+
+    return nil
+}
+
+// outstandingBalance is what is neither paid nor held for the order.
+func outstandingBalance(order *orderPb.Order) float32 {
+    return roundCents(order.TotalAmount - order.AmountPaid - order.AmountAuthorized)
+}
+
+func roundCents(amount float32) float32 {
+    return float32(math.Round(float64(amount)*100) / 100)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+    "time"
+
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
+)
+
+// terminalStatuses end a watch once the payment is no longer claimed:
+// nothing further happens to it on its own. Refunds and disputes may still
+// follow a capture, and a hold stays AUTHORIZED until it is captured,
+// voided or expires.
+var terminalStatuses = map[paymentPb.PaymentStatus]bool{
+    paymentPb.PaymentStatus_CAPTURED:           true,
+    paymentPb.PaymentStatus_PARTIALLY_REFUNDED: true,
+    paymentPb.PaymentStatus_REFUNDED:           true,
+    paymentPb.PaymentStatus_VOIDED:             true,
+    paymentPb.PaymentStatus_EXPIRED:            true,
+    paymentPb.PaymentStatus_DECLINED:           true,
+    paymentPb.PaymentStatus_FAILED:             true,
+}
+
+func (s *paymentService) WatchPayment(req *paymentPb.WatchPaymentRequest, stream paymentPb.PaymentService_WatchPaymentServer) error {
+    sent := 0
+    for {
+        payment, claimed, changed, err := s.watch(req.PaymentId)
+        if err != nil {
+            return err
+        }
+
+        for _, transition := range payment.StatusHistory[sent:] {
+            if err := stream.Send(&paymentPb.PaymentStatusUpdate{Transition: transition, Payment: payment}); err != nil {
+                return err
+            }
+        }
+        sent = len(payment.StatusHistory)
+        // A claimed payment may still change: a checkout captures before it
+        // confirms the order, and fails the payment if that does not work.
+        if terminalStatuses[payment.Status] && !claimed {
+            return nil
+        }
+
+        select {
+        case <-stream.Context().Done():
+            return stream.Context().Err()
+        case <-changed:
+        }
+    }
+}
+
+// watch returns a copy of a payment, whether an operation has claimed it,
+// and a channel that is closed on its next status transition or when the
+// claim is released.
+func (s *paymentService) watch(paymentID string) (*paymentPb.Payment, bool, <-chan struct{}, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    payment, exists := s.payments[paymentID]
+    if !exists {
+        return nil, false, nil, status.Errorf(codes.NotFound, "payment not found")
+    }
+
+    changed, exists := s.watchers[paymentID]
+    if !exists {
+        changed = make(chan struct{})
+        s.watchers[paymentID] = changed
+    }
+    claimed := s.inFlight[payment.OrderId] == payment.Id
+    return proto.Clone(payment).(*paymentPb.Payment), claimed, changed, nil
+}
+
+// recordStatus appends a transition if the payment's status changed since
+// it was last recorded, and wakes its watchers. reservePayment,
+// updatePayment and settleRefund call it after every change, so statuses
+// can be set directly. It must be called with s.mu held.
+func (s *paymentService) recordStatus(payment *paymentPb.Payment) {
+    var last paymentPb.PaymentStatus
+    if n := len(payment.StatusHistory); n > 0 {
+        last = payment.StatusHistory[n-1].ToStatus
+    }
+    if payment.Status == last {
+        return
+    }
+
+    transition := &paymentPb.PaymentStatusTransition{
+        FromStatus: last,
+        ToStatus:   payment.Status,
+        ChangedAt:  time.Now().Format(time.RFC3339),
+    }
+    if payment.Status == paymentPb.PaymentStatus_DECLINED || payment.Status == paymentPb.PaymentStatus_FAILED {
+        transition.Reason = payment.FailureReason
+    }
+    payment.StatusHistory = append(payment.StatusHistory, transition)
+    s.wakeWatchers(payment.Id)
+}
+
+// wakeWatchers must be called with s.mu held.
+func (s *paymentService) wakeWatchers(paymentID string) {
+    if changed, exists := s.watchers[paymentID]; exists {
+        close(changed)
+        delete(s.watchers, paymentID)
+    }
+}
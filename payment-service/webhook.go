@@ -0,0 +1,459 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    orderPb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+)
+
+const (
+    webhookPaymentSucceeded = "payment.succeeded"
+    webhookPaymentFailed    = "payment.failed"
+    webhookPaymentRefunded  = "payment.refunded"
+    webhookPaymentDisputed  = "payment.disputed"
+    webhookDisputeClosed    = "dispute.closed"
+
+    webhookSignatureHeader = "Gateway-Signature"
+    webhookMaxBody         = 1 << 20
+    // webhookRetention is how long processed event IDs are remembered.
+    webhookRetention = 72 * time.Hour
+)
+
+// webhookEvent is what the gateway posts. Data carries the gateway's IDs
+// for the operation; PaymentID is our ID, passed to the gateway as
+// metadata when authorizing.
+type webhookEvent struct {
+    ID      string      `json:"id"`
+    Type    string      `json:"type"`
+    Created int64       `json:"created"`
+    Data    webhookData `json:"data"`
+}
+
+type webhookData struct {
+    PaymentID       string  `json:"payment_id,omitempty"`
+    AuthorizationID string  `json:"authorization_id"`
+    CaptureID       string  `json:"capture_id,omitempty"`
+    RefundID        string  `json:"refund_id,omitempty"`
+    DisputeID       string  `json:"dispute_id,omitempty"`
+    Amount          float32 `json:"amount,omitempty"`
+    Code            string  `json:"code,omitempty"`
+    Reason          string  `json:"reason,omitempty"`
+    // EvidenceDueBy is a Unix time, set on payment.disputed events.
+    EvidenceDueBy int64 `json:"evidence_due_by,omitempty"`
+    // Outcome is "won" or "lost", set on dispute.closed events.
+    Outcome string `json:"outcome,omitempty"`
+}
+
+// errWebhookRetry asks the gateway to deliver the event again later,
+// because the payment is busy with another operation.
+var errWebhookRetry = errors.New("payment is busy, retry later")
+
+// signWebhook returns the signature header for body sent at timestamp:
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">".
+func signWebhook(secret []byte, timestamp time.Time, body []byte) string {
+    t := strconv.FormatInt(timestamp.Unix(), 10)
+    return "t=" + t + ",v1=" + webhookMAC(secret, t, body)
+}
+
+func webhookMAC(secret []byte, timestamp string, body []byte) string {
+    mac := hmac.New(sha256.New, secret)
+    mac.Write([]byte(timestamp + "."))
+    mac.Write(body)
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyWebhook checks header against body and rejects signatures older or
+// newer than tolerance, so captured requests cannot be replayed later.
+func verifyWebhook(secret []byte, header string, body []byte, now time.Time, tolerance time.Duration) error {
+    var timestamp string
+    var signatures []string
+    for _, part := range strings.Split(header, ",") {
+        key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+        switch key {
+        case "t":
+            timestamp = value
+        case "v1":
+            signatures = append(signatures, value)
+        }
+    }
+    if timestamp == "" || len(signatures) == 0 {
+        return errors.New("malformed signature header")
+    }
+
+    seconds, err := strconv.ParseInt(timestamp, 10, 64)
+    if err != nil {
+        return errors.New("malformed signature timestamp")
+    }
+    if age := now.Sub(time.Unix(seconds, 0)); age > tolerance || age < -tolerance {
+        return fmt.Errorf("signature timestamp is %s off", age.Round(time.Second))
+    }
+
+    expected := webhookMAC(secret, timestamp, body)
+    for _, signature := range signatures {
+        if hmac.Equal([]byte(signature), []byte(expected)) {
+            return nil
+        }
+    }
+    return errors.New("signature does not match")
+}
+
+// handleWebhook verifies, deduplicates and applies one gateway event. Any
+// non-2xx answer makes the gateway retry, so permanent problems with an
+// event are logged and acknowledged.
+func (s *paymentService) handleWebhook(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, webhookMaxBody))
+    if err != nil {
+        http.Error(w, "failed to read body", http.StatusBadRequest)
+        return
+    }
+    if err := verifyWebhook(s.config.webhookSecret, r.Header.Get(webhookSignatureHeader), body, time.Now(), s.config.webhookTolerance); err != nil {
+        http.Error(w, err.Error(), http.StatusUnauthorized)
+        return
+    }
+
+    var event webhookEvent
+    if err := json.Unmarshal(body, &event); err != nil || event.ID == "" {
+        http.Error(w, "malformed event", http.StatusBadRequest)
+        return
+    }
+
+    switch s.beginWebhook(event.ID) {
+    case webhookDone:
+        w.WriteHeader(http.StatusOK)
+        return
+    case webhookInProgress:
+        http.Error(w, "event is being processed", http.StatusConflict)
+        return
+    }
+
+    err = s.applyWebhook(r.Context(), &event)
+    s.finishWebhook(event.ID, err == nil)
+    switch {
+    case errors.Is(err, errWebhookRetry):
+        http.Error(w, err.Error(), http.StatusServiceUnavailable)
+    case err != nil:
+        log.Printf("webhook %s (%s) failed: %v", event.ID, event.Type, err)
+        http.Error(w, "failed to apply event", http.StatusInternalServerError)
+    default:
+        w.WriteHeader(http.StatusOK)
+    }
+}
+
+type webhookState int
+
+const (
+    webhookNew webhookState = iota
+    webhookInProgress
+    webhookDone
+)
+
+// beginWebhook claims an event ID. Only a webhookNew event may be applied.
+func (s *paymentService) beginWebhook(eventID string) webhookState {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if seen, exists := s.webhookEvents[eventID]; exists {
+        if seen.IsZero() {
+            return webhookInProgress
+        }
+        return webhookDone
+    }
+    s.webhookEvents[eventID] = time.Time{}
+    return webhookNew
+}
+
+// finishWebhook remembers an applied event, or forgets a failed one so a
+// redelivery is applied again. Old IDs are dropped on the way.
+func (s *paymentService) finishWebhook(eventID string, applied bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if !applied {
+        delete(s.webhookEvents, eventID)
+        return
+    }
+    now := time.Now()
+    s.webhookEvents[eventID] = now
+    s.webhookApplied = append(s.webhookApplied, eventID)
+    for len(s.webhookApplied) > 0 {
+        oldest := s.webhookApplied[0]
+        if now.Sub(s.webhookEvents[oldest]) <= webhookRetention {
+            break
+        }
+        delete(s.webhookEvents, oldest)
+        s.webhookApplied = s.webhookApplied[1:]
+    }
+}
+
+func (s *paymentService) applyWebhook(ctx context.Context, event *webhookEvent) error {
+    paymentID := s.findPaymentByReference(event.Data.PaymentID, event.Data.AuthorizationID)
+    if paymentID == "" {
+        log.Printf("webhook %s (%s): no payment for authorization %s", event.ID, event.Type, event.Data.AuthorizationID)
+        return nil
+    }
+
+    // Webhooks take the same per-order lock as API calls, so they never
+    // race a synchronous operation that is applying the same change.
+    payment, err := s.claimPayment(paymentID, allPaymentStatuses()...)
+    if err != nil {
+        return errWebhookRetry
+    }
+    defer s.releaseOrder(payment.OrderId)
+
+    switch event.Type {
+    case webhookPaymentSucceeded:
+        return s.applyCaptureWebhook(ctx, payment, event)
+    case webhookPaymentFailed:
+        return s.applyFailureWebhook(ctx, payment, event)
+    case webhookPaymentRefunded:
+        return s.applyRefundWebhook(ctx, payment, event)
+    case webhookPaymentDisputed:
+        s.applyDisputeWebhook(payment, event)
+    case webhookDisputeClosed:
+        s.applyDisputeClosedWebhook(ctx, payment, event)
+    default:
+        log.Printf("ignoring webhook %s of unknown type %q", event.ID, event.Type)
+    }
+    return nil
+}
+
+// applyCaptureWebhook applies a capture we did not see complete, typically
+// one whose call timed out. Captures already journaled are ignored.
+func (s *paymentService) applyCaptureWebhook(ctx context.Context, payment *paymentPb.Payment, event *webhookEvent) error {
+    if s.journaled(payment.Id, paymentPb.JournalEntryType_CAPTURE, event.Data.CaptureID) {
+        return nil
+    }
+    if payment.Status != paymentPb.PaymentStatus_AUTHORIZED && payment.Status != paymentPb.PaymentStatus_PARTIALLY_CAPTURED {
+        log.Printf("webhook %s: capture for payment %s, which is %s", event.ID, payment.Id, payment.Status)
+        return nil
+    }
+    amount := event.Data.Amount
+    if uncaptured := roundCents(payment.AuthorizedAmount - payment.CapturedAmount); amount <= 0 || amount > uncaptured+amountTolerance {
+        log.Printf("webhook %s: capture of %.2f for payment %s with %.2f uncaptured", event.ID, amount, payment.Id, uncaptured)
+        return nil
+    }
+
+    payment, err := s.updateJournaled(payment.Id, func(p *paymentPb.Payment) error {
+        p.CapturedAmount = roundCents(p.CapturedAmount + amount)
+        if p.CapturedAmount >= p.AuthorizedAmount-amountTolerance {
+            p.Status = paymentPb.PaymentStatus_CAPTURED
+        } else {
+            p.Status = paymentPb.PaymentStatus_PARTIALLY_CAPTURED
+        }
+        return s.postCapture(p, amount, event.Data.CaptureID)
+    })
+    if err != nil {
+        return err
+    }
+
+    // ProcessPayment charges never record their hold on the order.
+    record := &orderPb.RecordPaymentRequest{
+        Kind:              orderPb.PaymentRecordKind_PAYMENT_CAPTURED,
+        FromAuthorization: !payment.CaptureOnApproval,
+    }
+    fillRecord(record, payment, amount, event.Data.CaptureID)
+    s.notifyOrder(ctx, payment, func(ctx context.Context) error {
+        _, err := s.orderClient.RecordPayment(ctx, record)
+        return err
+    })
+    return nil
+}
+
+// applyFailureWebhook handles a hold the issuer dropped before it was
+// captured.
+func (s *paymentService) applyFailureWebhook(ctx context.Context, payment *paymentPb.Payment, event *webhookEvent) error {
+    if payment.Status != paymentPb.PaymentStatus_AUTHORIZED {
+        return nil
+    }
+
+    released := roundCents(payment.AuthorizedAmount - payment.CapturedAmount)
+    payment, err := s.updateJournaled(payment.Id, func(p *paymentPb.Payment) error {
+        p.Status = paymentPb.PaymentStatus_FAILED
+        p.FailureReason = fmt.Sprintf("failed at the gateway: %s (%s)", event.Data.Reason, event.Data.Code)
+        return s.postRelease(p, released, "void:"+p.GatewayReference)
+    })
+    if err != nil {
+        return err
+    }
+    if payment.CaptureOnApproval {
+        return nil
+    }
+
+    record := &orderPb.RecordPaymentRequest{Kind: orderPb.PaymentRecordKind_AUTHORIZATION_RELEASED}
+    fillRecord(record, payment, released, "void:"+payment.GatewayReference)
+    s.notifyOrder(ctx, payment, func(ctx context.Context) error {
+        _, err := s.orderClient.RecordPayment(ctx, record)
+        return err
+    })
+    return nil
+}
+
+// applyRefundWebhook records a refund made at the gateway rather than
+// through RefundPayment. Refunds we made ourselves are recognised by their
+// gateway reference.
+func (s *paymentService) applyRefundWebhook(ctx context.Context, payment *paymentPb.Payment, event *webhookEvent) error {
+    for _, refund := range payment.Refunds {
+        if refund.GatewayReference == event.Data.RefundID {
+            return nil
+        }
+    }
+    for _, refund := range payment.Refunds {
+        if refund.Status == paymentPb.RefundStatus_REFUND_PENDING {
+            // This may be that refund, still waiting for its reference.
+            return errWebhookRetry
+        }
+    }
+
+    amount := event.Data.Amount
+    limit := roundCents(payment.CapturedAmount - payment.RefundedAmount)
+    if !refundable(payment) || amount <= 0 || amount > limit+amountTolerance {
+        log.Printf("webhook %s: refund of %.2f for payment %s, which is %s with %.2f refundable", event.ID, amount, payment.Id, payment.Status, limit)
+        return nil
+    }
+
+    var refundID string
+    s.updatePayment(payment.Id, func(p *paymentPb.Payment) {
+        s.refundSeq++
+        refundID = fmt.Sprintf("refund_%d", s.refundSeq)
+        p.Refunds = append(p.Refunds, &paymentPb.Refund{
+            Id:        refundID,
+            PaymentId: p.Id,
+            Amount:    roundCents(amount),
+            Reason:    event.Data.Reason,
+            Status:    paymentPb.RefundStatus_REFUND_PENDING,
+            CreatedAt: time.Now().Format(time.RFC3339),
+        })
+    })
+    payment, refund, err := s.settleRefund(payment.Id, refundID, func(r *paymentPb.Refund) {
+        r.Status = paymentPb.RefundStatus_REFUND_SUCCEEDED
+        r.GatewayReference = event.Data.RefundID
+    })
+    if err != nil {
+        return err
+    }
+
+    notified := s.notifyOrder(ctx, payment, func(ctx context.Context) error {
+        return s.notifyOrderOfRefund(ctx, payment, refund)
+    })
+    if notified {
+        s.settleRefund(payment.Id, refundID, func(r *paymentPb.Refund) {
+            r.OrderUpdated = true
+        })
+    }
+    return nil
+}
+
+// applyDisputeWebhook opens a dispute the gateway reported. Disputes that
+// cannot be opened are logged and acknowledged: redelivery would not help.
+func (s *paymentService) applyDisputeWebhook(payment *paymentPb.Payment, event *webhookEvent) {
+    req := disputeRequest{
+        PaymentID:        payment.Id,
+        Amount:           event.Data.Amount,
+        Reason:           event.Data.Reason,
+        GatewayReference: event.Data.DisputeID,
+        Actor:            "gateway",
+    }
+    if event.Data.EvidenceDueBy > 0 {
+        req.EvidenceDueBy = time.Unix(event.Data.EvidenceDueBy, 0)
+    }
+    if _, _, err := s.openDispute(req); err != nil {
+        log.Printf("webhook %s: failed to open dispute %s on payment %s: %v", event.ID, event.Data.DisputeID, payment.Id, err)
+    }
+}
+
+// applyDisputeClosedWebhook applies the gateway's decision on a dispute.
+func (s *paymentService) applyDisputeClosedWebhook(ctx context.Context, payment *paymentPb.Payment, event *webhookEvent) {
+    var disputeID string
+    for _, dispute := range payment.Disputes {
+        if dispute.GatewayReference == event.Data.DisputeID {
+            disputeID = dispute.Id
+        }
+    }
+    outcome := map[string]paymentPb.DisputeStatus{
+        "won":  paymentPb.DisputeStatus_DISPUTE_WON,
+        "lost": paymentPb.DisputeStatus_DISPUTE_LOST,
+    }[event.Data.Outcome]
+    if disputeID == "" || outcome == paymentPb.DisputeStatus_DISPUTE_STATUS_UNSPECIFIED {
+        log.Printf("webhook %s: ignoring %q outcome of unknown dispute %s", event.ID, event.Data.Outcome, event.Data.DisputeID)
+        return
+    }
+
+    payment, dispute, err := s.closeDispute(disputeID, outcome, "gateway", "")
+    if err != nil {
+        log.Printf("webhook %s: failed to close dispute %s: %v", event.ID, disputeID, err)
+        return
+    }
+    if outcome == paymentPb.DisputeStatus_DISPUTE_LOST {
+        s.recordChargeback(ctx, payment, dispute)
+    }
+}
+
+// notifyOrder retries an order update made on behalf of a webhook and
+// reports whether it went through. Failures are logged: the payment is
+// already updated and reconciliation catches the order up.
+func (s *paymentService) notifyOrder(ctx context.Context, payment *paymentPb.Payment, call func(context.Context) error) bool {
+    if _, err := s.attempt(context.WithoutCancel(ctx), true, call); err != nil {
+        log.Printf("payment %s updated from a webhook but the order was not: %v", payment.Id, err)
+        return false
+    }
+    return true
+}
+
+// findPaymentByReference resolves a webhook to a payment, by our ID when
+// the gateway echoed it and by authorization ID otherwise.
+func (s *paymentService) findPaymentByReference(paymentID, authorizationID string) string {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    if payment, exists := s.payments[paymentID]; exists && (authorizationID == "" || payment.GatewayReference == authorizationID) {
+        return paymentID
+    }
+    if authorizationID == "" {
+        return ""
+    }
+    for _, id := range s.paymentIDs {
+        if s.payments[id].GatewayReference == authorizationID {
+            return id
+        }
+    }
+    return ""
+}
+
+// journaled reports whether an entry of entryType with reference was posted
+// for a payment.
+func (s *paymentService) journaled(paymentID string, entryType paymentPb.JournalEntryType, reference string) bool {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    for _, i := range s.journalByPayment[paymentID] {
+        if entry := s.journal[i]; entry.Type == entryType && entry.Reference == reference {
+            return true
+        }
+    }
+    return false
+}
+
+func allPaymentStatuses() []paymentPb.PaymentStatus {
+    statuses := make([]paymentPb.PaymentStatus, 0, len(paymentPb.PaymentStatus_name))
+    for value := range paymentPb.PaymentStatus_name {
+        statuses = append(statuses, paymentPb.PaymentStatus(value))
+    }
+    return statuses
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "testing"
+    "time"
+
+    orderPb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/status"
+)
+
+// fakeOrderClient serves one order and records what the payment service
+// reports for it. Only the calls the payment service makes are
+// implemented.
+type fakeOrderClient struct {
+    orderPb.OrderServiceClient
+
+    mu        sync.Mutex
+    order     *orderPb.Order
+    recordErr error
+    records   []*orderPb.RecordPaymentRequest
+    refunds   []*orderPb.RecordRefundRequest
+}
+
+func (c *fakeOrderClient) GetOrder(ctx context.Context, in *orderPb.GetOrderRequest, opts ...grpc.CallOption) (*orderPb.OrderResponse, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if c.order == nil || in.Id != c.order.Id {
+        return nil, status.Errorf(codes.NotFound, "order not found")
+    }
+    return &orderPb.OrderResponse{Order: c.order}, nil
+}
+
+func (c *fakeOrderClient) RecordPayment(ctx context.Context, in *orderPb.RecordPaymentRequest, opts ...grpc.CallOption) (*orderPb.OrderResponse, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if c.recordErr != nil {
+        return nil, c.recordErr
+    }
+    c.records = append(c.records, in)
+    return &orderPb.OrderResponse{Order: c.order}, nil
+}
+
+func (c *fakeOrderClient) RecordRefund(ctx context.Context, in *orderPb.RecordRefundRequest, opts ...grpc.CallOption) (*orderPb.OrderResponse, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.refunds = append(c.refunds, in)
+    return &orderPb.OrderResponse{Order: c.order}, nil
+}
+
+func TestVerifyWebhook(t *testing.T) {
+    secret := []byte("whsec_test")
+    body := []byte(`{"id":"evt_1","type":"payment.succeeded"}`)
+    now := time.Unix(1_700_000_000, 0)
+    tolerance := 5 * time.Minute
+
+    tests := []struct {
+        name   string
+        header string
+        body   []byte
+        valid  bool
+    }{
+        {name: "valid", header: signWebhook(secret, now, body), body: body, valid: true},
+        {name: "valid within tolerance", header: signWebhook(secret, now.Add(-4*time.Minute), body), body: body, valid: true},
+        {name: "tampered body", header: signWebhook(secret, now, body), body: []byte(`{"id":"evt_1","type":"payment.refunded"}`)},
+        {name: "wrong secret", header: signWebhook([]byte("other"), now, body), body: body},
+        {name: "stale timestamp", header: signWebhook(secret, now.Add(-6*time.Minute), body), body: body},
+        {name: "just outside tolerance", header: signWebhook(secret, now.Add(-tolerance-time.Second), body), body: body},
+        {name: "future timestamp", header: signWebhook(secret, now.Add(6*time.Minute), body), body: body},
+        {name: "missing signature", header: "t=1700000000", body: body},
+        {name: "malformed timestamp", header: "t=yesterday,v1=00", body: body},
+        {name: "empty header", header: "", body: body},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            err := verifyWebhook(secret, tt.header, tt.body, now, tolerance)
+            if tt.valid && err != nil {
+                t.Fatalf("verifyWebhook: %v", err)
+            }
+            if !tt.valid && err == nil {
+                t.Fatalf("verifyWebhook accepted %q", tt.header)
+            }
+        })
+    }
+}
+
+// TestHandleWebhookReplayedEvent redelivers an applied event while its
+// payment is claimed: applying it again would be answered with a retry, so
+// a 200 shows the event ID was recognised and the event skipped.
+func TestHandleWebhookReplayedEvent(t *testing.T) {
+    secret := []byte("whsec_test")
+    s := newPaymentService(nil, nil, nil, paymentServiceConfig{webhookSecret: secret, webhookTolerance: 5 * time.Minute})
+    s.payments["pay_1"] = &paymentPb.Payment{Id: "pay_1", OrderId: "order_1", Status: paymentPb.PaymentStatus_CAPTURED}
+    s.paymentIDs = append(s.paymentIDs, "pay_1")
+
+    deliver := func(body string) int {
+        req := httptest.NewRequest(http.MethodPost, "/webhooks/gateway", bytes.NewReader([]byte(body)))
+        req.Header.Set(webhookSignatureHeader, signWebhook(secret, time.Now(), []byte(body)))
+        rec := httptest.NewRecorder()
+        s.handleWebhook(rec, req)
+        return rec.Code
+    }
+
+    event := `{"id":"evt_1","type":"payment.noted","data":{"payment_id":"pay_1"}}`
+    if code := deliver(event); code != http.StatusOK {
+        t.Fatalf("first delivery: got %d, want %d", code, http.StatusOK)
+    }
+
+    s.inFlight["order_1"] = "pay_1"
+    tests := []struct {
+        name string
+        body string
+        code int
+    }{
+        {name: "replayed event ID", body: event, code: http.StatusOK},
+        {name: "new event ID", body: `{"id":"evt_2","type":"payment.noted","data":{"payment_id":"pay_1"}}`, code: http.StatusServiceUnavailable},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if code := deliver(tt.body); code != tt.code {
+                t.Fatalf("got %d, want %d", code, tt.code)
+            }
+        })
+    }
+}
+
+// TestHandleWebhookAppliesEvents delivers a capture and a refund made at
+// the gateway and checks both the payment and what the order was told.
+func TestHandleWebhookAppliesEvents(t *testing.T) {
+    secret := []byte("whsec_test")
+
+    tests := []struct {
+        name     string
+        payment  *paymentPb.Payment
+        event    string
+        status   paymentPb.PaymentStatus
+        captured float32
+        refunded float32
+        records  int
+        refunds  int
+    }{
+        {
+            name:     "capture",
+            payment:  &paymentPb.Payment{Id: "pay_1", OrderId: "order_1", Currency: "USD", Amount: 30, AuthorizedAmount: 30, GatewayReference: "auth_1", Status: paymentPb.PaymentStatus_AUTHORIZED},
+            event:    `{"id":"evt_1","type":"payment.succeeded","data":{"payment_id":"pay_1","authorization_id":"auth_1","capture_id":"cap_1","amount":30}}`,
+            status:   paymentPb.PaymentStatus_CAPTURED,
+            captured: 30,
+            records:  1,
+        },
+        {
+            name:     "partial refund",
+            payment:  &paymentPb.Payment{Id: "pay_1", OrderId: "order_1", Currency: "USD", Amount: 30, AuthorizedAmount: 30, CapturedAmount: 30, GatewayReference: "auth_1", Status: paymentPb.PaymentStatus_CAPTURED},
+            event:    `{"id":"evt_1","type":"payment.refunded","data":{"payment_id":"pay_1","authorization_id":"auth_1","refund_id":"gw_refund_1","amount":10,"reason":"goodwill"}}`,
+            status:   paymentPb.PaymentStatus_PARTIALLY_REFUNDED,
+            captured: 30,
+            refunded: 10,
+            refunds:  1,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            orders := &fakeOrderClient{}
+            s := newPaymentService(orders, nil, nil, paymentServiceConfig{webhookSecret: secret, webhookTolerance: 5 * time.Minute})
+            s.payments[tt.payment.Id] = tt.payment
+            s.paymentIDs = append(s.paymentIDs, tt.payment.Id)
+
+            req := httptest.NewRequest(http.MethodPost, "/webhooks/gateway", bytes.NewReader([]byte(tt.event)))
+            req.Header.Set(webhookSignatureHeader, signWebhook(secret, time.Now(), []byte(tt.event)))
+            rec := httptest.NewRecorder()
+            s.handleWebhook(rec, req)
+            if rec.Code != http.StatusOK {
+                t.Fatalf("got %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+            }
+
+            payment := s.snapshot(tt.payment.Id)
+            if payment.Status != tt.status || payment.CapturedAmount != tt.captured || payment.RefundedAmount != tt.refunded {
+                t.Errorf("payment is %s with %.2f captured and %.2f refunded, want %s with %.2f and %.2f",
+                    payment.Status, payment.CapturedAmount, payment.RefundedAmount, tt.status, tt.captured, tt.refunded)
+            }
+            if len(orders.records) != tt.records || len(orders.refunds) != tt.refunds {
+                t.Fatalf("order got %d payment records and %d refunds, want %d and %d", len(orders.records), len(orders.refunds), tt.records, tt.refunds)
+            }
+            if tt.records > 0 {
+                record := orders.records[0]
+                if record.Kind != orderPb.PaymentRecordKind_PAYMENT_CAPTURED || record.Amount != tt.captured || record.RecordId != "cap_1" {
+                    t.Errorf("order record is %s of %.2f as %s, want PAYMENT_CAPTURED of %.2f as cap_1", record.Kind, record.Amount, record.RecordId, tt.captured)
+                }
+            }
+            if tt.refunds > 0 {
+                refund := orders.refunds[0]
+                if refund.Amount != tt.refunded || refund.PaymentId != tt.payment.Id {
+                    t.Errorf("order refund is %.2f for %s, want %.2f for %s", refund.Amount, refund.PaymentId, tt.refunded, tt.payment.Id)
+                }
+            }
+        })
+    }
+}
@@ -0,0 +1,181 @@
+// Command reconcile compares the order service's orders with the payment
+// service's payments and reports where they disagree. With -repair it
+// replays payment and refund records the order service missed; everything
+// else is left for a person to look at.
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "sort"
+
+    orderPb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+    "google.golang.org/grpc"
+)
+
+// reconcilerActor is recorded on the order history for repairs.
+const reconcilerActor = "reconciler"
+
+// listPageSize is the ListPayments page size; it is the service's maximum.
+const listPageSize = 100
+
+func main() {
+    ordersAddr := flag.String("orders", os.Getenv("ORDER_SERVICE_ADDR"), "order service address")
+    paymentsAddr := flag.String("payments", os.Getenv("PAYMENT_SERVICE_ADDR"), "payment service address")
+    repair := flag.Bool("repair", false, "replay records the order service missed")
+    format := flag.String("format", "text", "output format: text or ndjson")
+    flag.Parse()
+
+    var write func(io.Writer, []*finding) error
+    switch *format {
+    case "text":
+        write = writeText
+    case "ndjson":
+        write = writeNDJSON
+    default:
+        log.Fatalf("unknown format %q", *format)
+    }
+
+    orderConn, err := grpc.Dial(*ordersAddr, grpc.WithInsecure())
+    if err != nil {
+        log.Fatalf("failed to connect to order service: %v", err)
+    }
+    defer orderConn.Close()
+    orderClient := orderPb.NewOrderServiceClient(orderConn)
+
+    paymentConn, err := grpc.Dial(*paymentsAddr, grpc.WithInsecure())
+    if err != nil {
+        log.Fatalf("failed to connect to payment service: %v", err)
+    }
+    defer paymentConn.Close()
+    paymentClient := paymentPb.NewPaymentServiceClient(paymentConn)
+
+    ctx := context.Background()
+
+    // Payments are listed before orders are exported, so every settled
+    // payment was already recorded, or given up on, when the orders are
+    // read. Changes in between show up as mismatches that a rerun clears.
+    payments, err := listPayments(ctx, paymentClient)
+    if err != nil {
+        log.Fatalf("failed to list payments: %v", err)
+    }
+    orders, err := exportOrders(ctx, orderClient)
+    if err != nil {
+        log.Fatalf("failed to export orders: %v", err)
+    }
+
+    findings := reconcile(orders, payments)
+    if *repair {
+        for _, f := range findings {
+            if !f.Repairable {
+                continue
+            }
+            if err := f.repair(ctx, orderClient); err != nil {
+                f.RepairError = err.Error()
+                continue
+            }
+            f.Repaired = true
+        }
+    }
+
+    if err := write(os.Stdout, findings); err != nil {
+        log.Fatalf("failed to write report: %v", err)
+    }
+
+    log.Printf("checked %d orders and %d payments", len(orders), len(payments))
+    for _, f := range findings {
+        if !f.Repaired {
+            os.Exit(1)
+        }
+    }
+}
+
+func exportOrders(ctx context.Context, client orderPb.OrderServiceClient) (map[string]*orderPb.Order, error) {
+    stream, err := client.ExportOrders(ctx, &orderPb.ExportOrdersRequest{})
+    if err != nil {
+        return nil, err
+    }
+
+    orders := make(map[string]*orderPb.Order)
+    for {
+        order, err := stream.Recv()
+        if err == io.EOF {
+            return orders, nil
+        }
+        if err != nil {
+            return nil, err
+        }
+        orders[order.Id] = order
+    }
+}
+
+func listPayments(ctx context.Context, client paymentPb.PaymentServiceClient) ([]*paymentPb.Payment, error) {
+    var payments []*paymentPb.Payment
+    for page := int32(1); ; page++ {
+        resp, err := client.ListPayments(ctx, &paymentPb.ListPaymentsRequest{Page: page, Limit: listPageSize})
+        if err != nil {
+            return nil, err
+        }
+        payments = append(payments, resp.Payments...)
+        if len(resp.Payments) < listPageSize || len(payments) >= int(resp.Total) {
+            return payments, nil
+        }
+    }
+}
+
+// writeText prints one line per finding followed by counts per category.
+func writeText(w io.Writer, findings []*finding) error {
+    counts := make(map[string]int)
+    for _, f := range findings {
+        counts[f.Category]++
+
+        state := ""
+        switch {
+        case f.Repaired:
+            state = " [repaired]"
+        case f.RepairError != "":
+            state = fmt.Sprintf(" [repair failed: %s]", f.RepairError)
+        case f.Repairable:
+            state = " [repairable]"
+        }
+        payment := f.PaymentID
+        if payment == "" {
+            payment = "-"
+        }
+        if _, err := fmt.Fprintf(w, "%-16s %-12s %-12s %s%s\n", f.Category, f.OrderID, payment, f.Detail, state); err != nil {
+            return err
+        }
+    }
+
+    categories := make([]string, 0, len(counts))
+    for category := range counts {
+        categories = append(categories, category)
+    }
+    sort.Strings(categories)
+
+    if _, err := fmt.Fprintf(w, "%d findings\n", len(findings)); err != nil {
+        return err
+    }
+    for _, category := range categories {
+        if _, err := fmt.Fprintf(w, "  %s: %d\n", category, counts[category]); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func writeNDJSON(w io.Writer, findings []*finding) error {
+    encoder := json.NewEncoder(w)
+    for _, f := range findings {
+        if err := encoder.Encode(f); err != nil {
+            return err
+        }
+    }
+    return nil
+}
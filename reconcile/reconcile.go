@@ -0,0 +1,342 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "slices"
+
+    orderPb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+)
+
+// amountTolerance absorbs float32 rounding when comparing money amounts.
+const amountTolerance = 0.005
+
+const (
+    categoryOrphanPayment  = "orphan_payment"
+    categoryOrphanOrder    = "orphan_order"
+    categoryAmountMismatch = "amount_mismatch"
+    categoryStatusMismatch = "status_mismatch"
+)
+
+// finding is one disagreement between the two services. Findings with a
+// repair can be fixed automatically without guessing: the repair replays
+// an idempotent record the order service missed.
+type finding struct {
+    Category    string `json:"category"`
+    OrderID     string `json:"order_id"`
+    PaymentID   string `json:"payment_id,omitempty"`
+    Detail      string `json:"detail"`
+    Repairable  bool   `json:"repairable"`
+    Repaired    bool   `json:"repaired"`
+    RepairError string `json:"repair_error,omitempty"`
+
+    repair func(context.Context, orderPb.OrderServiceClient) error
+}
+
+// paidStatuses are order statuses that imply the order was paid in full.
+var paidStatuses = map[string]bool{
+    "confirmed":    true,
+    "shipped":      true,
+    "delivered":    true,
+    "returned":     true,
+    "refunded":     true,
+    "charged_back": true,
+}
+
+// unpaidStatuses are order statuses still waiting for payment.
+var unpaidStatuses = map[string]bool{
+    "pending":        true,
+    "partially_paid": true,
+    "authorized":     true,
+}
+
+// reconcile compares orders with their payments.
+func reconcile(orders map[string]*orderPb.Order, payments []*paymentPb.Payment) []*finding {
+    var findings []*finding
+
+    byOrder := make(map[string][]*paymentPb.Payment)
+    for _, payment := range payments {
+        if _, exists := orders[payment.OrderId]; !exists {
+            if movedMoney(payment) {
+                findings = append(findings, &finding{
+                    Category:  categoryOrphanPayment,
+                    OrderID:   payment.OrderId,
+                    PaymentID: payment.Id,
+                    Detail:    fmt.Sprintf("%s payment for an order that does not exist", payment.Status),
+                })
+            }
+            continue
+        }
+        byOrder[payment.OrderId] = append(byOrder[payment.OrderId], payment)
+    }
+
+    for _, order := range orders {
+        findings = append(findings, reconcileOrder(order, byOrder[order.Id])...)
+    }
+
+    slices.SortFunc(findings, func(a, b *finding) int {
+        if a.OrderID != b.OrderID {
+            if a.OrderID < b.OrderID {
+                return -1
+            }
+            return 1
+        }
+        if a.PaymentID < b.PaymentID {
+            return -1
+        }
+        if a.PaymentID > b.PaymentID {
+            return 1
+        }
+        return 0
+    })
+    return findings
+}
+
+func reconcileOrder(order *orderPb.Order, payments []*paymentPb.Payment) []*finding {
+    var findings []*finding
+    var captured, held, refunded, chargedBack float32
+
+    for _, payment := range payments {
+        if !counts(payment) || inProgress(payment) {
+            continue
+        }
+        compensated := compensatedAmount(payment)
+        captured += payment.CapturedAmount - compensated
+        refunded += payment.RefundedAmount - compensated
+        chargedBack += payment.ChargedBackAmount
+        if payment.Status == paymentPb.PaymentStatus_AUTHORIZED || payment.Status == paymentPb.PaymentStatus_PARTIALLY_CAPTURED {
+            held += payment.AuthorizedAmount - payment.CapturedAmount
+        }
+
+        if !slices.Contains(order.PaymentIds, payment.Id) {
+            findings = append(findings, unrecordedPayment(order, payment))
+            continue
+        }
+        for _, refund := range payment.Refunds {
+            if reportedRefund(refund) && !slices.Contains(order.RefundIds, refund.Id) {
+                findings = append(findings, unrecordedRefund(order, payment, refund))
+            }
+        }
+        for _, dispute := range payment.Disputes {
+            if dispute.Status == paymentPb.DisputeStatus_DISPUTE_LOST && !slices.Contains(order.ChargebackIds, dispute.Id) {
+                findings = append(findings, unrecordedChargeback(order, payment, dispute))
+            }
+        }
+    }
+
+    if captured <= amountTolerance && (paidStatuses[order.Status] || order.AmountPaid > amountTolerance) {
+        return append(findings, &finding{
+            Category: categoryOrphanOrder,
+            OrderID:  order.Id,
+            Detail:   fmt.Sprintf("order is %s with %.2f paid but has no captured payment", order.Status, order.AmountPaid),
+        })
+    }
+    if len(findings) > 0 {
+        // The totals below would only restate the unrecorded payments.
+        return findings
+    }
+
+    mismatches := []struct {
+        name          string
+        order, actual float32
+    }{
+        {"paid", order.AmountPaid, captured},
+        {"authorized", order.AmountAuthorized, held},
+        {"refunded", order.AmountRefunded, refunded},
+        {"charged back", order.AmountChargedBack, chargedBack},
+    }
+    for _, m := range mismatches {
+        if diff := m.order - m.actual; diff > amountTolerance || diff < -amountTolerance {
+            findings = append(findings, &finding{
+                Category: categoryAmountMismatch,
+                OrderID:  order.Id,
+                Detail:   fmt.Sprintf("order has %.2f %s, payments have %.2f", m.order, m.name, m.actual),
+            })
+        }
+    }
+    if len(findings) > 0 {
+        return findings
+    }
+
+    coversTotal := captured >= order.TotalAmount-amountTolerance
+    switch {
+    case coversTotal && unpaidStatuses[order.Status]:
+        findings = append(findings, &finding{
+            Category: categoryStatusMismatch,
+            OrderID:  order.Id,
+            Detail:   fmt.Sprintf("payments cover the total of %.2f but the order is %s", order.TotalAmount, order.Status),
+        })
+    case !coversTotal && paidStatuses[order.Status]:
+        findings = append(findings, &finding{
+            Category: categoryStatusMismatch,
+            OrderID:  order.Id,
+            Detail:   fmt.Sprintf("order is %s but payments cover only %.2f of %.2f", order.Status, captured, order.TotalAmount),
+        })
+    }
+    return findings
+}
+
+// unrecordedPayment reports a payment the order never heard of. Nothing of
+// it was recorded, so its capture, remaining hold and refunds can be
+// replayed. The hold is recorded under its authorization ID, the same
+// record ID the payment service uses, so it cannot be applied twice.
+func unrecordedPayment(order *orderPb.Order, payment *paymentPb.Payment) *finding {
+    captured := payment.CapturedAmount - compensatedAmount(payment)
+    uncaptured := payment.AuthorizedAmount - payment.CapturedAmount
+    open := payment.Status == paymentPb.PaymentStatus_AUTHORIZED || payment.Status == paymentPb.PaymentStatus_PARTIALLY_CAPTURED
+
+    return &finding{
+        Category:   categoryAmountMismatch,
+        OrderID:    order.Id,
+        PaymentID:  payment.Id,
+        Detail:     fmt.Sprintf("%s payment with %.2f captured is not recorded on the order", payment.Status, captured),
+        Repairable: true,
+        repair: func(ctx context.Context, client orderPb.OrderServiceClient) error {
+            if captured > amountTolerance {
+                if _, err := client.RecordPayment(ctx, &orderPb.RecordPaymentRequest{
+                    OrderId:   order.Id,
+                    PaymentId: payment.Id,
+                    Amount:    captured,
+                    Currency:  payment.Currency,
+                    Actor:     reconcilerActor,
+                    Kind:      orderPb.PaymentRecordKind_PAYMENT_CAPTURED,
+                    RecordId:  "reconcile:" + payment.Id + ":capture",
+                }); err != nil {
+                    return err
+                }
+            }
+            if open && uncaptured > amountTolerance {
+                if _, err := client.RecordPayment(ctx, &orderPb.RecordPaymentRequest{
+                    OrderId:   order.Id,
+                    PaymentId: payment.Id,
+                    Amount:    uncaptured,
+                    Currency:  payment.Currency,
+                    Actor:     reconcilerActor,
+                    Kind:      orderPb.PaymentRecordKind_PAYMENT_AUTHORIZED,
+                    RecordId:  payment.GatewayReference,
+                }); err != nil {
+                    return err
+                }
+            }
+            for _, refund := range payment.Refunds {
+                if !reportedRefund(refund) {
+                    continue
+                }
+                if err := unrecordedRefund(order, payment, refund).repair(ctx, client); err != nil {
+                    return err
+                }
+            }
+            for _, dispute := range payment.Disputes {
+                if dispute.Status != paymentPb.DisputeStatus_DISPUTE_LOST {
+                    continue
+                }
+                if err := unrecordedChargeback(order, payment, dispute).repair(ctx, client); err != nil {
+                    return err
+                }
+            }
+            return nil
+        },
+    }
+}
+
+// unrecordedRefund reports a refund the order missed. RecordRefund is
+// idempotent by refund ID, so replaying it is safe.
+func unrecordedRefund(order *orderPb.Order, payment *paymentPb.Payment, refund *paymentPb.Refund) *finding {
+    return &finding{
+        Category:   categoryAmountMismatch,
+        OrderID:    order.Id,
+        PaymentID:  payment.Id,
+        Detail:     fmt.Sprintf("refund %s of %.2f is not recorded on the order", refund.Id, refund.Amount),
+        Repairable: true,
+        repair: func(ctx context.Context, client orderPb.OrderServiceClient) error {
+            _, err := client.RecordRefund(ctx, &orderPb.RecordRefundRequest{
+                OrderId:   order.Id,
+                PaymentId: payment.Id,
+                RefundId:  refund.Id,
+                Amount:    refund.Amount,
+                Currency:  payment.Currency,
+                Actor:     reconcilerActor,
+                Reason:    refund.Reason,
+            })
+            return err
+        },
+    }
+}
+
+// unrecordedChargeback reports a lost dispute the order missed.
+// RecordChargeback is idempotent by dispute ID, so replaying it is safe.
+func unrecordedChargeback(order *orderPb.Order, payment *paymentPb.Payment, dispute *paymentPb.Dispute) *finding {
+    return &finding{
+        Category:   categoryAmountMismatch,
+        OrderID:    order.Id,
+        PaymentID:  payment.Id,
+        Detail:     fmt.Sprintf("lost dispute %s of %.2f is not recorded on the order", dispute.Id, dispute.Amount),
+        Repairable: true,
+        repair: func(ctx context.Context, client orderPb.OrderServiceClient) error {
+            _, err := client.RecordChargeback(ctx, &orderPb.RecordChargebackRequest{
+                OrderId:   order.Id,
+                PaymentId: payment.Id,
+                DisputeId: dispute.Id,
+                Amount:    dispute.Amount,
+                Currency:  payment.Currency,
+                Actor:     reconcilerActor,
+                Reason:    dispute.Reason,
+            })
+            return err
+        },
+    }
+}
+
+// reportedRefund reports whether the order should know about a refund.
+// Compensations reverse captures the order never confirmed.
+func reportedRefund(refund *paymentPb.Refund) bool {
+    return refund.Status == paymentPb.RefundStatus_REFUND_SUCCEEDED && !refund.Compensation
+}
+
+// compensatedAmount is what compensations refunded.
+func compensatedAmount(payment *paymentPb.Payment) float32 {
+    var compensated float32
+    for _, refund := range payment.Refunds {
+        if refund.Compensation && refund.Status == paymentPb.RefundStatus_REFUND_SUCCEEDED {
+            compensated += refund.Amount
+        }
+    }
+    return compensated
+}
+
+// counts reports whether a payment's money should show on its order. A
+// payment in any other status counts as long as it kept some of what it
+// captured: a saga whose compensation failed may have left a failed
+// payment with the customer's money taken.
+func counts(payment *paymentPb.Payment) bool {
+    switch payment.Status {
+    case paymentPb.PaymentStatus_AUTHORIZED,
+        paymentPb.PaymentStatus_PARTIALLY_CAPTURED,
+        paymentPb.PaymentStatus_CAPTURED,
+        paymentPb.PaymentStatus_PARTIALLY_REFUNDED,
+        paymentPb.PaymentStatus_REFUNDED:
+        return true
+    default:
+        // RefundedAmount includes what compensations refunded.
+        return payment.CapturedAmount-payment.RefundedAmount > amountTolerance
+    }
+}
+
+// inProgress reports whether the payment service is still working on a
+// payment. Its order may not have been told yet, and replaying records
+// next to the service's own retries could apply them twice.
+func inProgress(payment *paymentPb.Payment) bool {
+    for _, saga := range payment.Sagas {
+        if saga.State == paymentPb.SagaState_SAGA_RUNNING || saga.State == paymentPb.SagaState_SAGA_COMPENSATING {
+            return true
+        }
+    }
+    return false
+}
+
+// movedMoney reports whether a payment holds or took money that is not
+// accounted for elsewhere.
+func movedMoney(payment *paymentPb.Payment) bool {
+    return counts(payment) && (payment.AuthorizedAmount > amountTolerance || payment.CapturedAmount > amountTolerance)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+    "testing"
+
+    orderPb "github.com/AleksKislov/grpc_microservices_test/proto/order"
+    paymentPb "github.com/AleksKislov/grpc_microservices_test/proto/payment"
+)
+
+// TestFailedPaymentsThatKeptMoney covers failed payments whose saga could
+// not give the captured money back: they are reported whatever their
+// status, while compensated ones are not.
+func TestFailedPaymentsThatKeptMoney(t *testing.T) {
+    failed := func(id, orderID string, compensated float32) *paymentPb.Payment {
+        payment := &paymentPb.Payment{
+            Id:               id,
+            OrderId:          orderID,
+            Status:           paymentPb.PaymentStatus_FAILED,
+            Amount:           30,
+            AuthorizedAmount: 30,
+            CapturedAmount:   30,
+        }
+        if compensated > 0 {
+            payment.RefundedAmount = compensated
+            payment.Refunds = []*paymentPb.Refund{{
+                Id:           "refund_" + id,
+                Amount:       compensated,
+                Status:       paymentPb.RefundStatus_REFUND_SUCCEEDED,
+                Compensation: true,
+            }}
+        }
+        return payment
+    }
+
+    tests := []struct {
+        name     string
+        payment  *paymentPb.Payment
+        category string
+    }{
+        {name: "compensated", payment: failed("payment_1", "order_1", 30)},
+        {name: "not compensated", payment: failed("payment_1", "order_1", 0), category: categoryAmountMismatch},
+        {name: "partly compensated", payment: failed("payment_1", "order_1", 10), category: categoryAmountMismatch},
+        {name: "orphan", payment: failed("payment_1", "order_missing", 0), category: categoryOrphanPayment},
+        {name: "compensated orphan", payment: failed("payment_1", "order_missing", 30)},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            orders := map[string]*orderPb.Order{
+                "order_1": {Id: "order_1", TotalAmount: 30, Currency: "USD", Status: "pending"},
+            }
+            findings := reconcile(orders, []*paymentPb.Payment{tt.payment})
+
+            if tt.category == "" {
+                if len(findings) != 0 {
+                    t.Fatalf("got findings %+v, want none", findings[0])
+                }
+                return
+            }
+            if len(findings) != 1 || findings[0].Category != tt.category || findings[0].PaymentID != tt.payment.Id {
+                t.Fatalf("got %d findings, want one %s for %s", len(findings), tt.category, tt.payment.Id)
+            }
+        })
+    }
+}
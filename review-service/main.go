@@ -15,6 +15,7 @@ import (
     "google.golang.org/grpc"
     "google.golang.org/grpc/codes"
     "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/proto"
 )
 
 type reviewService struct {
@@ -52,7 +53,9 @@ func (s *reviewService) CreateReview(ctx context.Context, req *reviewPb.CreateRe
         return nil, status.Errorf(codes.InvalidArgument, "order not found: %v", err)
     }
 
-    if orderResp.Order.Status != "confirmed" {
+    switch orderResp.Order.Status {
+    case "confirmed", "shipped", "delivered":
+    default:
         return nil, status.Errorf(codes.FailedPrecondition, "order is not confirmed yet")
     }
 
@@ -72,7 +75,7 @@ func (s *reviewService) CreateReview(ctx context.Context, req *reviewPb.CreateRe
 
     s.reviews[reviewId] = review
 
-    return &reviewPb.ReviewResponse{Review: review}, nil
+    return &reviewPb.ReviewResponse{Review: proto.Clone(review).(*reviewPb.Review)}, nil
 }
 
 func (s *reviewService) GetReview(ctx context.Context, req *reviewPb.GetReviewRequest) (*reviewPb.ReviewResponse, error) {
@@ -84,7 +87,7 @@ func (s *reviewService) GetReview(ctx context.Context, req *reviewPb.GetReviewRe
         return nil, status.Errorf(codes.NotFound, "review not found")
     }
 
-    return &reviewPb.ReviewResponse{Review: review}, nil
+    return &reviewPb.ReviewResponse{Review: proto.Clone(review).(*reviewPb.Review)}, nil
 }
 
 func main() {
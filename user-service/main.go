@@ -5,6 +5,7 @@ import (
     "log"
     "net"
     "sync"
+    "time"
 
     pb "github.com/AleksKislov/grpc_microservices_test/proto/user"
     "google.golang.org/grpc"
@@ -41,6 +42,7 @@ func (s *server) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb
         Email: req.Email,
         Name:  req.Name,
         Phone: req.Phone,
+        CreatedAt: time.Now().Format(time.RFC3339),
     }
 
     s.users[user.Id] = user